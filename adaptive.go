@@ -0,0 +1,405 @@
+package ratelimit
+
+// 自适应并发数限制，思路参考 Netflix concurrency-limits
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Sample 一个请求处理完之后的采样
+type Sample struct {
+	RTT      time.Duration // 处理耗时，不包括排队
+	Inflight int64         // 开始处理时正在处理的请求数，包括自己
+	Dropped  bool          // 超时、5xx 等说明下游已经过载的情况
+}
+
+// LimitAlgorithm 根据采样调整并发数，由 AdaptiveLimiter 加锁调用，不需要自己保证并发安全
+type LimitAlgorithm interface {
+	Limit() int64
+	Update(s Sample) int64
+}
+
+// limitBounds 并发数的上下限
+type limitBounds struct {
+	min, max int64
+}
+
+func (b limitBounds) clamp(limit float64) float64 {
+	return math.Max(float64(b.min), math.Min(float64(b.max), limit))
+}
+
+func (b limitBounds) check() {
+	if b.min <= 0 || b.max < b.min {
+		panic("adaptive limit bounds are not 0 < min <= max")
+	}
+}
+
+// AIMD 加性增乘性减，没有丢弃时每个请求加 1，丢弃或者超时时乘以 backoff
+type AIMD struct {
+	limitBounds
+	limit   float64
+	backoff float64
+	timeout time.Duration
+}
+
+type aimdOpt func(a *AIMD)
+
+// AIMDWithLimits 并发数的上下限，默认 [1, 1000]
+func AIMDWithLimits(min, max int64) aimdOpt {
+	return func(a *AIMD) {
+		a.min, a.max = min, max
+	}
+}
+
+// AIMDWithBackoff 丢弃时并发数乘以 ratio，默认 0.9
+func AIMDWithBackoff(ratio float64) aimdOpt {
+	return func(a *AIMD) {
+		if ratio <= 0 || ratio >= 1 {
+			panic("aimd backoff ratio is not in (0, 1)")
+		}
+		a.backoff = ratio
+	}
+}
+
+// AIMDWithTimeout 耗时超过 timeout 的请求也当作丢弃，默认 5 秒
+func AIMDWithTimeout(timeout time.Duration) aimdOpt {
+	return func(a *AIMD) {
+		a.timeout = timeout
+	}
+}
+
+// NewAIMD 初始并发数为 initial
+func NewAIMD(initial int64, opts ...aimdOpt) *AIMD {
+	a := &AIMD{
+		limitBounds: limitBounds{min: 1, max: 1000},
+		backoff:     0.9,
+		timeout:     5 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	a.check()
+	a.limit = a.clamp(float64(initial))
+	return a
+}
+
+func (a *AIMD) Limit() int64 {
+	return int64(a.limit)
+}
+
+func (a *AIMD) Update(s Sample) int64 {
+	switch {
+	case s.Dropped || s.RTT > a.timeout:
+		a.limit = a.clamp(a.limit * a.backoff)
+	case s.Inflight*2 >= int64(a.limit):
+		// 只有并发数被用起来了才增加，否则没有证据说明下游还能承受更多
+		a.limit = a.clamp(a.limit + 1)
+	}
+	return int64(a.limit)
+}
+
+// Vegas 参考 TCP Vegas，用最小耗时作为没有排队时的耗时来估算排队的请求数，
+// 排队少时快速增加，排队多时减少
+type Vegas struct {
+	limitBounds
+	limit      float64
+	rttNoLoad  time.Duration
+	probe      int64 // 每 probe 个采样重新测量一次最小耗时，0 表示不重新测量
+	sinceProbe int64
+}
+
+type vegasOpt func(v *Vegas)
+
+// VegasWithLimits 并发数的上下限，默认 [1, 1000]
+func VegasWithLimits(min, max int64) vegasOpt {
+	return func(v *Vegas) {
+		v.min, v.max = min, max
+	}
+}
+
+// VegasWithProbe 每 n 个采样丢掉记录的最小耗时重新测量，适应下游变慢的情况，默认 1000
+func VegasWithProbe(n int64) vegasOpt {
+	return func(v *Vegas) {
+		v.probe = n
+	}
+}
+
+// NewVegas 初始并发数为 initial
+func NewVegas(initial int64, opts ...vegasOpt) *Vegas {
+	v := &Vegas{
+		limitBounds: limitBounds{min: 1, max: 1000},
+		probe:       1000,
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	v.check()
+	v.limit = v.clamp(float64(initial))
+	return v
+}
+
+func (v *Vegas) Limit() int64 {
+	return int64(v.limit)
+}
+
+func (v *Vegas) Update(s Sample) int64 {
+	if s.RTT <= 0 {
+		return int64(v.limit)
+	}
+	v.sinceProbe++
+	if v.probe > 0 && v.sinceProbe >= v.probe {
+		v.sinceProbe = 0
+		v.rttNoLoad = 0
+	}
+	if v.rttNoLoad == 0 || s.RTT < v.rttNoLoad {
+		v.rttNoLoad = s.RTT
+		return int64(v.limit)
+	}
+
+	step := math.Max(1, math.Log10(v.limit))
+	switch {
+	case s.Dropped:
+		v.limit = v.clamp(v.limit - step)
+	case s.Inflight*2 < int64(v.limit):
+		// 并发数没有用起来
+	default:
+		queue := math.Ceil(v.limit * (1 - float64(v.rttNoLoad)/float64(s.RTT)))
+		alpha, beta := 3*step, 6*step
+		switch {
+		case queue <= step:
+			v.limit = v.clamp(v.limit + beta)
+		case queue < alpha:
+			v.limit = v.clamp(v.limit + step)
+		case queue > beta:
+			v.limit = v.clamp(v.limit - step)
+		}
+	}
+	return int64(v.limit)
+}
+
+// Gradient2 比较长期平均耗时和当前耗时的比值(梯度)调整并发数，
+// 耗时变长时按比例减少，耗时不变时每次增加 sqrt(limit) 作为排队的余量
+type Gradient2 struct {
+	limitBounds
+	limit     float64
+	tolerance float64 // 当前耗时是长期平均的多少倍以内不减少
+	smoothing float64
+	longRTT   expAverage
+}
+
+type gradientOpt func(g *Gradient2)
+
+// Gradient2WithLimits 并发数的上下限，默认 [1, 1000]
+func Gradient2WithLimits(min, max int64) gradientOpt {
+	return func(g *Gradient2) {
+		g.min, g.max = min, max
+	}
+}
+
+// Gradient2WithTolerance 当前耗时不超过长期平均的 tolerance 倍时不减少，默认 1.5
+func Gradient2WithTolerance(tolerance float64) gradientOpt {
+	return func(g *Gradient2) {
+		if tolerance < 1 {
+			panic("gradient tolerance is not >= 1")
+		}
+		g.tolerance = tolerance
+	}
+}
+
+// Gradient2WithSmoothing 每次向新的并发数靠近的比例，默认 0.2
+func Gradient2WithSmoothing(smoothing float64) gradientOpt {
+	return func(g *Gradient2) {
+		if smoothing <= 0 || smoothing > 1 {
+			panic("gradient smoothing is not in (0, 1]")
+		}
+		g.smoothing = smoothing
+	}
+}
+
+// Gradient2WithLongWindow 长期平均耗时大约覆盖最近多少个采样，默认 600
+func Gradient2WithLongWindow(window int) gradientOpt {
+	return func(g *Gradient2) {
+		if window <= 0 {
+			panic("gradient long window is not > 0")
+		}
+		g.longRTT.window = window
+	}
+}
+
+// NewGradient2 初始并发数为 initial
+func NewGradient2(initial int64, opts ...gradientOpt) *Gradient2 {
+	g := &Gradient2{
+		limitBounds: limitBounds{min: 1, max: 1000},
+		tolerance:   1.5,
+		smoothing:   0.2,
+		longRTT:     expAverage{window: 600, warmup: 10},
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	g.check()
+	g.limit = g.clamp(float64(initial))
+	return g
+}
+
+func (g *Gradient2) Limit() int64 {
+	return int64(g.limit)
+}
+
+func (g *Gradient2) Update(s Sample) int64 {
+	if s.RTT <= 0 {
+		return int64(g.limit)
+	}
+	shortRTT := float64(s.RTT)
+	longRTT := g.longRTT.add(shortRTT)
+
+	// 长期平均比当前耗时大很多时说明负载已经降下来了，让长期平均尽快跟上
+	if longRTT/shortRTT > 2 {
+		longRTT = g.longRTT.scale(0.95)
+	}
+	// 并发数没有用起来，不调整
+	if !s.Dropped && s.Inflight*2 < int64(g.limit) {
+		return int64(g.limit)
+	}
+
+	gradient := math.Max(0.5, math.Min(1, g.tolerance*longRTT/shortRTT))
+	if s.Dropped {
+		gradient = 0.5
+	}
+	newLimit := g.limit*gradient + math.Sqrt(g.limit)
+	g.limit = g.clamp(g.limit*(1-g.smoothing) + newLimit*g.smoothing)
+	return int64(g.limit)
+}
+
+// expAverage 指数移动平均，前 warmup 个采样使用算术平均
+type expAverage struct {
+	window int
+	warmup int
+	count  int
+	value  float64
+}
+
+func (e *expAverage) add(sample float64) float64 {
+	if e.count < e.warmup {
+		e.count++
+		e.value += (sample - e.value) / float64(e.count)
+	} else {
+		factor := 2 / float64(e.window+1)
+		e.value = e.value*(1-factor) + sample*factor
+	}
+	return e.value
+}
+
+func (e *expAverage) scale(ratio float64) float64 {
+	e.value *= ratio
+	return e.value
+}
+
+// AdaptiveLimiter 并发数由 LimitAlgorithm 根据每个请求的耗时和结果自动调整
+type AdaptiveLimiter struct {
+	sem   *ConcurrencyLimiter
+	clock Clock
+
+	mu        sync.Mutex
+	algorithm LimitAlgorithm
+}
+
+type adaptiveOpt func(a *AdaptiveLimiter)
+
+func AdaptiveWithClock(clock Clock) adaptiveOpt {
+	return func(a *AdaptiveLimiter) {
+		if clock == nil {
+			clock = realClock{}
+		}
+		a.clock = clock
+	}
+}
+
+// NewAdaptiveLimiter 初始并发数为 algorithm.Limit()
+func NewAdaptiveLimiter(algorithm LimitAlgorithm, opts ...adaptiveOpt) *AdaptiveLimiter {
+	a := &AdaptiveLimiter{
+		sem:       NewConcurrencyLimiter(algorithm.Limit()),
+		clock:     realClock{},
+		algorithm: algorithm,
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// TryAcquire 不等待，拿到许可时返回处理完之后需要调用的 done
+func (a *AdaptiveLimiter) TryAcquire() (done func(dropped bool), ok bool) {
+	if !a.sem.TryAcquire() {
+		return nil, false
+	}
+	return a.begin(), true
+}
+
+// Acquire 等待直到拿到许可，处理完之后调用 done 上报结果并归还许可
+func (a *AdaptiveLimiter) Acquire(ctx context.Context) (done func(dropped bool), err error) {
+	if err := a.sem.Acquire(ctx); err != nil {
+		return nil, err
+	}
+	return a.begin(), nil
+}
+
+// begin 已经拿到许可，开始计时
+func (a *AdaptiveLimiter) begin() func(dropped bool) {
+	start := a.clock.Now()
+	inflight := a.sem.Inflight()
+	var once sync.Once
+	return func(dropped bool) {
+		once.Do(func() {
+			sample := Sample{RTT: a.clock.Now().Sub(start), Inflight: inflight, Dropped: dropped}
+			a.mu.Lock()
+			limit := a.algorithm.Update(sample)
+			a.mu.Unlock()
+			if limit < 1 {
+				limit = 1
+			}
+			a.sem.SetLimit(limit)
+			a.sem.Release()
+		})
+	}
+}
+
+// Limit 当前的并发数限制
+func (a *AdaptiveLimiter) Limit() int64 {
+	return a.sem.Limit()
+}
+
+// Inflight 正在处理的请求数
+func (a *AdaptiveLimiter) Inflight() int64 {
+	return a.sem.Inflight()
+}
+
+// 自适应并发数 所有请求共用 limiter，5xx 的响应和 panic 当作丢弃，
+// keyFunc 只用来决定哪些请求不限流，排队的行为和 ConcurrencyMiddleware 一样
+func AdaptiveMiddleware(limiter *AdaptiveLimiter, opts ...MiddlewareOption) func(http.Handler) http.Handler {
+	conf := newMiddlewareConfig(opts...)
+	var waiting int64
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := limitKey(w, r, conf, next); !ok {
+				return
+			}
+			if !acquireConcurrency(w, r, conf, limiter.sem, &waiting) {
+				return
+			}
+			done := limiter.begin()
+			w, info := trackUsage(w)
+			completed := false
+			defer func() {
+				done(!completed || info.Status() >= http.StatusInternalServerError)
+			}()
+			next.ServeHTTP(w, r)
+			completed = true
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAIMD(t *testing.T) {
+	a := NewAIMD(10, AIMDWithLimits(5, 12), AIMDWithTimeout(time.Second))
+	assert.Equal(t, int64(10), a.Limit())
+
+	// 并发数没有用起来时不增加
+	assert.Equal(t, int64(10), a.Update(Sample{RTT: time.Millisecond, Inflight: 1}))
+	assert.Equal(t, int64(11), a.Update(Sample{RTT: time.Millisecond, Inflight: 5}))
+	assert.Equal(t, int64(12), a.Update(Sample{RTT: time.Millisecond, Inflight: 10}))
+	assert.Equal(t, int64(12), a.Update(Sample{RTT: time.Millisecond, Inflight: 12}))
+
+	assert.Equal(t, int64(10), a.Update(Sample{RTT: time.Millisecond, Inflight: 12, Dropped: true}))
+	assert.Equal(t, int64(9), a.Update(Sample{RTT: 2 * time.Second, Inflight: 10}))
+	for i := 0; i < 10; i++ {
+		a.Update(Sample{Dropped: true})
+	}
+	assert.Equal(t, int64(5), a.Limit())
+}
+
+func TestVegas(t *testing.T) {
+	v := NewVegas(10, VegasWithLimits(1, 100), VegasWithProbe(0))
+	// 第一个采样只记录没有排队时的耗时
+	assert.Equal(t, int64(10), v.Update(Sample{RTT: 10 * time.Millisecond, Inflight: 10}))
+
+	// 没有排队，快速增加 6*log10(limit)
+	assert.Equal(t, int64(16), v.Update(Sample{RTT: 10 * time.Millisecond, Inflight: 10}))
+	// 排队 ceil(16*(1-10/12)) = 3 个，在 [log10, 3*log10) 之间，增加 log10(limit)
+	assert.Equal(t, int64(17), v.Update(Sample{RTT: 12 * time.Millisecond, Inflight: 16}))
+	// 排队 ceil(17*(1-10/20)) = 9 个，超过 6*log10(limit)，减少
+	assert.Equal(t, int64(15), v.Update(Sample{RTT: 20 * time.Millisecond, Inflight: 17}))
+	// 并发数没有用起来
+	assert.Equal(t, int64(15), v.Update(Sample{RTT: 20 * time.Millisecond, Inflight: 2}))
+	assert.Equal(t, int64(14), v.Update(Sample{RTT: 10 * time.Millisecond, Inflight: 2, Dropped: true}))
+}
+
+func TestVegasProbe(t *testing.T) {
+	v := NewVegas(10, VegasWithProbe(3))
+	v.Update(Sample{RTT: 10 * time.Millisecond, Inflight: 10})
+	v.Update(Sample{RTT: 50 * time.Millisecond, Inflight: 10})
+	// 重新测量之后下游整体变慢的耗时成为新的基准
+	limit := v.Update(Sample{RTT: 50 * time.Millisecond, Inflight: 10})
+	assert.Equal(t, limit, v.Update(Sample{RTT: 50 * time.Millisecond, Inflight: 1}))
+	assert.Greater(t, v.Update(Sample{RTT: 50 * time.Millisecond, Inflight: limit}), limit)
+}
+
+func TestGradient2(t *testing.T) {
+	g := NewGradient2(100, Gradient2WithLongWindow(10))
+	// 耗时稳定时增加
+	for i := 0; i < 20; i++ {
+		g.Update(Sample{RTT: 10 * time.Millisecond, Inflight: g.Limit()})
+	}
+	grown := g.Limit()
+	assert.Greater(t, grown, int64(100))
+
+	// 耗时突然变成 3 倍，梯度为 0.5，并发数下降
+	for i := 0; i < 5; i++ {
+		g.Update(Sample{RTT: 30 * time.Millisecond, Inflight: g.Limit()})
+	}
+	assert.Less(t, g.Limit(), grown)
+
+	// 并发数没有用起来时不调整
+	limit := g.Limit()
+	assert.Equal(t, limit, g.Update(Sample{RTT: time.Second, Inflight: 1}))
+}
+
+func TestAdaptiveLimiter(t *testing.T) {
+	clk := clock.NewMock()
+	a := NewAdaptiveLimiter(NewAIMD(2, AIMDWithTimeout(100*time.Millisecond)), AdaptiveWithClock(clk))
+
+	done1, ok := a.TryAcquire()
+	assert.True(t, ok)
+	done2, ok := a.TryAcquire()
+	assert.True(t, ok)
+	_, ok = a.TryAcquire()
+	assert.False(t, ok)
+
+	clk.Add(10 * time.Millisecond)
+	done1(false)
+	assert.Equal(t, int64(3), a.Limit())
+	// 只有第一次调用有效
+	done1(false)
+	assert.Equal(t, int64(1), a.Inflight())
+
+	// 超时当作丢弃
+	clk.Add(200 * time.Millisecond)
+	done2(false)
+	assert.Equal(t, int64(2), a.Limit())
+	assert.Equal(t, int64(0), a.Inflight())
+}
+
+func TestAdaptiveMiddleware(t *testing.T) {
+	a := NewAdaptiveLimiter(NewAIMD(10))
+	h := AdaptiveMiddleware(a, MiddlewareWithMaxWait(0))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/fail":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/panic":
+			panic("boom")
+		}
+	}))
+
+	assert.Equal(t, http.StatusOK, doRequest(h, "/ok", nil))
+	assert.Equal(t, int64(10), a.Limit())
+	assert.Equal(t, http.StatusInternalServerError, doRequest(h, "/fail", nil))
+	assert.Equal(t, int64(9), a.Limit())
+	assert.Panics(t, func() { doRequest(h, "/panic", nil) })
+	assert.Equal(t, int64(8), a.Limit())
+	assert.Equal(t, int64(0), a.Inflight())
+}
+
+func TestAdaptiveMiddlewareHijack(t *testing.T) {
+	a := NewAdaptiveLimiter(NewAIMD(10))
+	h := AdaptiveMiddleware(a)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hijacker, ok := w.(http.Hijacker); assert.True(t, ok) {
+			_, _, _ = hijacker.Hijack()
+		}
+	}))
+
+	w := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ws", nil))
+	assert.True(t, w.hijacked)
+	assert.Equal(t, int64(10), a.Limit())
+	assert.Equal(t, int64(0), a.Inflight())
+}
@@ -0,0 +1,305 @@
+package ratelimit
+
+// 根据 CPU 使用率和处理能力自适应丢弃请求，思路参考 kratos 的 BBR
+
+import (
+	"math"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BBR CPU 使用率超过阈值，并且正在处理的请求数超过了估算的最大处理能力时丢弃请求
+//
+// 最大处理能力 = 滑动窗口内单个桶最多完成的请求数 * 最小耗时 / 桶的时长，
+// 也就是按最快的速度处理时系统里最多能同时有多少个请求。
+// 丢弃之后的 coolDown 时间内即使 CPU 降下来了也继续按处理能力判断，避免刚恢复就被打满
+type BBR struct {
+	clock     Clock
+	cpu       func() int64 // CPU 使用率，千分比
+	sampler   *cpuSampler  // 默认的 CPU 使用率来源，没有设置 BBRWithCPU 时才有
+	threshold int64
+	coolDown  time.Duration
+
+	bucketDuration time.Duration
+	mu             sync.Mutex
+	buckets        []bbrBucket
+
+	inflight int64
+	prevDrop int64 // 上次丢弃的时间(unix nanoseconds)，atomic
+}
+
+type bbrBucket struct {
+	index  int64 // 第几个桶，用来判断桶里的数据是不是已经过期了
+	pass   int64 // 完成的请求数
+	rtSum  time.Duration
+	rtSize int64
+}
+
+// BBRStat 当前的状态
+type BBRStat struct {
+	CPU         int64         // CPU 使用率，千分比
+	Inflight    int64         // 正在处理的请求数
+	MaxPass     int64         // 窗口内单个桶最多完成的请求数
+	MinRT       time.Duration // 窗口内最小的平均耗时
+	MaxInflight int64         // 估算的最大处理能力
+}
+
+type bbrOpt func(b *BBR)
+
+func BBRWithClock(clock Clock) bbrOpt {
+	return func(b *BBR) {
+		if clock == nil {
+			clock = realClock{}
+		}
+		b.clock = clock
+	}
+}
+
+// BBRWithWindow 统计最近 window 时间内的数据，分成 buckets 个桶，默认 10 秒 100 个桶
+func BBRWithWindow(window time.Duration, buckets int) bbrOpt {
+	return func(b *BBR) {
+		if buckets <= 0 || window < time.Duration(buckets) {
+			panic("bbr window is not >= buckets > 0")
+		}
+		b.bucketDuration = window / time.Duration(buckets)
+		b.buckets = make([]bbrBucket, buckets)
+	}
+}
+
+// BBRWithCPUThreshold CPU 使用率超过 threshold(千分比) 时开始丢弃，默认 800
+func BBRWithCPUThreshold(threshold int64) bbrOpt {
+	return func(b *BBR) {
+		b.threshold = threshold
+	}
+}
+
+// BBRWithCPU 自定义 CPU 使用率(千分比)的来源，默认读取 /proc/self/stat 和 cgroup 的 CPU 配额，只支持 linux
+func BBRWithCPU(cpu func() int64) bbrOpt {
+	return func(b *BBR) {
+		b.cpu = cpu
+	}
+}
+
+// BBRWithCoolDown 丢弃之后多久内继续按处理能力判断，默认 1 秒
+func BBRWithCoolDown(coolDown time.Duration) bbrOpt {
+	return func(b *BBR) {
+		b.coolDown = coolDown
+	}
+}
+
+// NewBBR 没有设置 BBRWithCPU 时会启动后台协程采样 CPU 使用率，不用的时候需要 Close
+func NewBBR(opts ...bbrOpt) *BBR {
+	b := &BBR{
+		clock:     realClock{},
+		threshold: 800,
+		coolDown:  time.Second,
+	}
+	BBRWithWindow(10*time.Second, 100)(b)
+	for _, opt := range opts {
+		opt(b)
+	}
+	if b.cpu == nil {
+		b.sampler = newCPUSampler()
+		b.cpu = b.sampler.Usage
+	}
+	return b
+}
+
+// Close 停止后台的 CPU 采样
+func (b *BBR) Close() {
+	if b.sampler != nil {
+		b.sampler.Close()
+	}
+}
+
+// Allow 是否放行，放行时处理完之后需要调用 done
+func (b *BBR) Allow() (done func(), ok bool) {
+	if b.shouldDrop() {
+		atomic.StoreInt64(&b.prevDrop, b.clock.Now().UnixNano())
+		return nil, false
+	}
+	atomic.AddInt64(&b.inflight, 1)
+	start := b.clock.Now()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			now := b.clock.Now()
+			atomic.AddInt64(&b.inflight, -1)
+			b.add(now, now.Sub(start))
+		})
+	}, true
+}
+
+func (b *BBR) shouldDrop() bool {
+	if b.cpu() < b.threshold {
+		prevDrop := atomic.LoadInt64(&b.prevDrop)
+		if prevDrop == 0 || b.clock.Now().UnixNano()-prevDrop > int64(b.coolDown) {
+			return false
+		}
+	}
+	inflight := atomic.LoadInt64(&b.inflight)
+	return inflight > 1 && inflight > b.maxInflight(b.clock.Now())
+}
+
+// add 记录一个完成的请求
+func (b *BBR) add(now time.Time, rt time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bucket := b.bucket(now)
+	bucket.pass++
+	bucket.rtSum += rt
+	bucket.rtSize++
+}
+
+// bucket now 所在的桶，过期的数据会被清掉，调用前需要持有锁
+func (b *BBR) bucket(now time.Time) *bbrBucket {
+	index := now.UnixNano() / int64(b.bucketDuration)
+	bucket := &b.buckets[index%int64(len(b.buckets))]
+	if bucket.index != index {
+		*bucket = bbrBucket{index: index}
+	}
+	return bucket
+}
+
+// stat 窗口内除了当前这个还没结束的桶之外的统计，没有数据时按 1 个请求、1ms 计算
+func (b *BBR) stat(now time.Time) (maxPass int64, minRT time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	current := now.UnixNano() / int64(b.bucketDuration)
+	for i := range b.buckets {
+		bucket := &b.buckets[i]
+		if bucket.index >= current || bucket.index <= current-int64(len(b.buckets)) {
+			continue
+		}
+		if bucket.pass > maxPass {
+			maxPass = bucket.pass
+		}
+		if bucket.rtSize > 0 {
+			if rt := bucket.rtSum / time.Duration(bucket.rtSize); minRT == 0 || rt < minRT {
+				minRT = rt
+			}
+		}
+	}
+	if maxPass <= 0 {
+		maxPass = 1
+	}
+	if minRT <= 0 {
+		minRT = time.Millisecond
+	}
+	return maxPass, minRT
+}
+
+func (b *BBR) maxInflight(now time.Time) int64 {
+	maxPass, minRT := b.stat(now)
+	return int64(math.Floor(float64(maxPass)*float64(minRT)/float64(b.bucketDuration) + 0.5))
+}
+
+func (b *BBR) Stat() BBRStat {
+	now := b.clock.Now()
+	maxPass, minRT := b.stat(now)
+	return BBRStat{
+		CPU:         b.cpu(),
+		Inflight:    atomic.LoadInt64(&b.inflight),
+		MaxPass:     maxPass,
+		MinRT:       minRT,
+		MaxInflight: b.maxInflight(now),
+	}
+}
+
+// BBR 过载保护 CPU 使用率过高并且正在处理的请求数超过处理能力时拒绝，所有请求共用 bbr，
+// keyFunc 只用来决定哪些请求不限流
+func BBRMiddleware(bbr *BBR, opts ...MiddlewareOption) func(http.Handler) http.Handler {
+	conf := newMiddlewareConfig(opts...)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := limitKey(w, r, conf, next); !ok {
+				return
+			}
+			done, ok := bbr.Allow()
+			if !ok {
+				conf.denyHandler(w, r, Result{RetryAfter: -1})
+				return
+			}
+			defer done()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+////////////////////
+// 进程的 CPU 使用率
+////////////////////
+
+const (
+	cpuSampleInterval = 500 * time.Millisecond
+	cpuDecay          = 0.95 // 指数移动平均，平滑掉瞬间的抖动
+)
+
+// cpuSampler 后台定时采样进程的 CPU 使用率(千分比)，按可以使用的 CPU 核数归一化，
+// 容器里设置了 cgroup 的 CPU 配额时按配额算，不支持的系统上一直为 0
+type cpuSampler struct {
+	usage int64 // atomic
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+func newCPUSampler() *cpuSampler {
+	s := &cpuSampler{stop: make(chan struct{})}
+	prev, err := processCPUTime()
+	if err != nil {
+		return s
+	}
+	go s.loop(prev, cpuCores())
+	return s
+}
+
+func (s *cpuSampler) Usage() int64 {
+	return atomic.LoadInt64(&s.usage)
+}
+
+// Close 停止后台采样
+func (s *cpuSampler) Close() {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+	})
+}
+
+func (s *cpuSampler) loop(prev time.Duration, cores float64) {
+	ticker := time.NewTicker(cpuSampleInterval)
+	defer ticker.Stop()
+	var usage float64
+	prevTime := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+		cur, err := processCPUTime()
+		if err != nil {
+			continue
+		}
+		now := time.Now()
+		wall := float64(now.Sub(prevTime)) * cores
+		if wall <= 0 {
+			continue
+		}
+		sample := float64(cur-prev) / wall * 1000
+		usage = usage*cpuDecay + sample*(1-cpuDecay)
+		atomic.StoreInt64(&s.usage, int64(usage))
+		prev, prevTime = cur, now
+	}
+}
+
+// cpuCores 可以使用的 CPU 核数，cgroup 的配额比 CPU 核数少时使用配额
+func cpuCores() float64 {
+	cores := float64(runtime.NumCPU())
+	if quota, ok := cgroupCPUQuota(); ok && quota < cores {
+		return quota
+	}
+	return cores
+}
@@ -0,0 +1,98 @@
+package ratelimit
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBBR(t *testing.T) {
+	clk := clock.NewMock()
+	cpu := int64(100)
+	b := NewBBR(BBRWithClock(clk), BBRWithWindow(time.Second, 10),
+		BBRWithCPU(func() int64 { return atomic.LoadInt64(&cpu) }))
+
+	// 每 100ms 分两批完成 8 个请求，每个耗时 40ms，最多同时处理 8*40/100 = 3 个
+	for i := 0; i < 5; i++ {
+		for batch := 0; batch < 2; batch++ {
+			dones := make([]func(), 0, 4)
+			for j := 0; j < 4; j++ {
+				done, ok := b.Allow()
+				assert.True(t, ok)
+				dones = append(dones, done)
+			}
+			clk.Add(40 * time.Millisecond)
+			for _, done := range dones {
+				done()
+			}
+		}
+		clk.Add(20 * time.Millisecond)
+	}
+	stat := b.Stat()
+	assert.Equal(t, int64(8), stat.MaxPass)
+	assert.Equal(t, 40*time.Millisecond, stat.MinRT)
+	assert.Equal(t, int64(3), stat.MaxInflight)
+
+	atomic.StoreInt64(&cpu, 900)
+	var dones []func()
+	for i := 0; i < 4; i++ {
+		done, ok := b.Allow()
+		assert.True(t, ok)
+		dones = append(dones, done)
+	}
+	_, ok := b.Allow()
+	assert.False(t, ok)
+
+	// CPU 降下来了，冷却时间内还是按处理能力判断
+	atomic.StoreInt64(&cpu, 100)
+	_, ok = b.Allow()
+	assert.False(t, ok)
+	clk.Add(time.Second + time.Millisecond)
+	done, ok := b.Allow()
+	assert.True(t, ok)
+
+	done()
+	for _, done := range dones {
+		done()
+	}
+	assert.Equal(t, int64(0), b.Stat().Inflight)
+}
+
+func TestBBRMiddleware(t *testing.T) {
+	b := NewBBR(BBRWithCPU(func() int64 { return 1000 }))
+	block := make(chan struct{})
+	h := BBRMiddleware(b)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			<-block
+		}
+	}))
+
+	// 没有统计数据时按 1 个请求、1ms 估算，只允许同时处理 1 个
+	done := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() { done <- doRequest(h, "/block", nil) }()
+	}
+	for b.Stat().Inflight < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, doRequest(h, "/user/1", nil))
+	close(block)
+	assert.Equal(t, http.StatusOK, <-done)
+	assert.Equal(t, http.StatusOK, <-done)
+}
+
+func TestProcessCPUUsage(t *testing.T) {
+	if _, err := processCPUTime(); err != nil {
+		t.Skip(err)
+	}
+	b := NewBBR()
+	usage := b.Stat().CPU
+	assert.GreaterOrEqual(t, usage, int64(0))
+	assert.LessOrEqual(t, usage, int64(1000))
+	b.Close()
+	b.Close()
+}
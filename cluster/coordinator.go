@@ -0,0 +1,262 @@
+// Package cluster 多个实例共享一份限流配额
+//
+// 每个节点持有一个本地的令牌桶，定时把自己的容量和可用量上报到中心节点(registry.IRegistry)，
+// 同时在内存里缓存所有节点的信息，本地的令牌用完之后向最空闲的节点借容量，
+// 被借走容量的节点在下一次同步时缩小自己的桶。
+// 借到的只是容量，令牌要等桶按自己的速度补充，出借的节点在同步之前还在用这部分令牌，
+// 直接把令牌加到本地会让整个集群多放行
+package cluster
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/wwqdrh/ratelimit"
+	"github.com/wwqdrh/ratelimit/registry"
+)
+
+type Coordinator struct {
+	addr     string
+	registry registry.IRegistry
+	bucket   *ratelimit.Bucket
+
+	interval   time.Duration // 同步的间隔，0 表示不启动后台同步
+	total      int           // 整个集群的配额，0 表示不回收挂掉的节点的容量
+	borrowSize int           // 每次最少借多少
+
+	syncMu sync.Mutex // 同一时间只有一个 Sync，持有期间会访问 registry
+
+	// 访问 registry 时不持有 mu
+	mu        sync.Mutex
+	nodes     []registry.NodeInfo // 上一次同步时所有节点的信息
+	round     int                 // 同步的次数，借用期间同步过的话借到的容量留给下一次同步
+	borrowed  bool                // 这一轮已经借过了，不管有没有借到，都等下一次同步再借
+	borrowing bool                // 已经有请求在借了，其他请求不等它
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+type coordinatorOpt func(c *Coordinator)
+
+// WithInterval 多久同步一次，默认 5 秒，需要小于 registry 中节点的过期时间
+func WithInterval(interval time.Duration) coordinatorOpt {
+	return func(c *Coordinator) {
+		c.interval = interval
+	}
+}
+
+// WithTotal 整个集群的配额，设置之后新加入的节点从 0 开始，全部靠借，
+// 挂掉的节点的容量由地址最小的节点收回
+func WithTotal(total int) coordinatorOpt {
+	return func(c *Coordinator) {
+		c.total = total
+	}
+}
+
+// WithBorrowSize 每次最少借多少，默认为桶容量的十分之一
+func WithBorrowSize(size int) coordinatorOpt {
+	return func(c *Coordinator) {
+		c.borrowSize = size
+	}
+}
+
+// NewCoordinator addr 为当前节点在 registry 中的地址，bucket 的容量是当前节点的初始配额
+// 创建时会同步一次，之后按 interval 在后台同步
+func NewCoordinator(addr string, reg registry.IRegistry, bucket *ratelimit.Bucket, opts ...coordinatorOpt) *Coordinator {
+	c := &Coordinator{
+		addr:       addr,
+		registry:   reg,
+		bucket:     bucket,
+		interval:   5 * time.Second,
+		borrowSize: int(bucket.Capacity() / 10),
+		stop:       make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.borrowSize <= 0 {
+		c.borrowSize = 1
+	}
+	c.Sync()
+	if c.interval > 0 {
+		go c.loop()
+	}
+	return c
+}
+
+// Bucket 当前节点的令牌桶，容量会随着同步和借用变化
+func (c *Coordinator) Bucket() *ratelimit.Bucket {
+	return c.bucket
+}
+
+func (c *Coordinator) Allow() bool {
+	return c.AllowN(1)
+}
+
+// AllowN 本地的令牌不够时拒绝，并向其他节点借容量，之后补充的令牌可以存得更多
+func (c *Coordinator) AllowN(n int64) bool {
+	if c.bucket.AllowN(n) {
+		return true
+	}
+	c.borrow(n)
+	return false
+}
+
+// Nodes 上一次同步时所有节点的信息
+func (c *Coordinator) Nodes() []registry.NodeInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]registry.NodeInfo(nil), c.nodes...)
+}
+
+// Sync 上报当前节点的状态，并用 registry 中的容量更新本地的桶
+func (c *Coordinator) Sync() {
+	c.syncMu.Lock()
+	defer c.syncMu.Unlock()
+
+	nodes := c.registry.AllNodeInfo()
+	joined := indexOf(nodes, c.addr) < 0
+	if joined {
+		// 第一次同步，或者太久没有同步已经过期了
+		self := registry.NodeInfo{Addr: c.addr, Cap: int(c.bucket.Capacity()), Avaliable: int(c.bucket.Available())}
+		if c.total > 0 {
+			self.Cap = 0
+		}
+		if !c.registry.Initial(self) {
+			return
+		}
+		nodes = append(nodes, self)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Addr < nodes[j].Addr
+	})
+	idx := indexOf(nodes, c.addr)
+
+	if c.total > 0 && idx == 0 {
+		sum := 0
+		for _, node := range nodes {
+			if node.Cap > 0 {
+				sum += node.Cap
+			}
+		}
+		if missing := c.total - sum; missing > 0 && c.registry.SetCap(c.addr, nodes[idx].Cap+missing) {
+			nodes[idx].Cap += missing
+		}
+	}
+
+	if nodes[idx].Cap < 0 {
+		// registry 里的容量坏掉了，后台同步不能因此 panic，保留本地的容量
+		nodes[idx].Cap = int(c.bucket.Capacity())
+	}
+	c.mu.Lock()
+	c.bucket.SetCapacity(int64(nodes[idx].Cap))
+	nodes[idx].Avaliable = int(c.bucket.Available())
+	self := nodes[idx]
+	c.nodes = nodes
+	c.round++
+	c.borrowed = false
+	c.mu.Unlock()
+
+	if !joined {
+		c.report(self)
+	}
+}
+
+// report registry 没有实现 IReporter 时只能连同容量一起覆盖，可能会丢掉刚刚被借走的容量，
+// 读不到当前的容量时不上报，等下一次同步
+func (c *Coordinator) report(self registry.NodeInfo) {
+	if reporter, ok := c.registry.(registry.IReporter); ok {
+		reporter.Report(self.Addr, self.Avaliable)
+		return
+	}
+	if self.Cap = c.registry.GetCap(self.Addr); self.Cap < 0 {
+		return
+	}
+	c.registry.Initial(self)
+}
+
+// borrow 只向还有剩余令牌的节点借，按可用量从多到少依次尝试，每一轮同步最多借一次
+func (c *Coordinator) borrow(n int64) {
+	size := c.borrowSize
+	if int(n) > size {
+		size = int(n)
+	}
+
+	c.mu.Lock()
+	if c.borrowed || c.borrowing {
+		c.mu.Unlock()
+		return
+	}
+	c.borrowing = true
+	round := c.round
+	candidates := make([]registry.NodeInfo, 0, len(c.nodes))
+	for _, node := range c.nodes {
+		if node.Addr != c.addr && node.Cap >= size && node.Avaliable >= size {
+			candidates = append(candidates, node)
+		}
+	}
+	c.mu.Unlock()
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Avaliable > candidates[j].Avaliable
+	})
+	lender := ""
+	for _, node := range candidates {
+		if c.registry.Borrow(c.addr, node.Addr, size) {
+			lender = node.Addr
+			break
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.borrowing = false
+	if c.round != round {
+		// 借的时候同步过，不知道同步读到的容量里有没有这一次的，交给下一次同步
+		return
+	}
+	c.borrowed = true
+	if lender == "" {
+		return
+	}
+	if i := indexOf(c.nodes, lender); i >= 0 {
+		c.nodes[i].Cap -= size
+		c.nodes[i].Avaliable -= size
+	}
+	if i := indexOf(c.nodes, c.addr); i >= 0 {
+		c.nodes[i].Cap += size
+	}
+	// 只加容量，不加令牌
+	c.bucket.SetCapacity(c.bucket.Capacity() + int64(size))
+}
+
+func indexOf(nodes []registry.NodeInfo, addr string) int {
+	for i, node := range nodes {
+		if node.Addr == addr {
+			return i
+		}
+	}
+	return -1
+}
+
+// Close 停止后台同步
+func (c *Coordinator) Close() {
+	c.closeOnce.Do(func() {
+		close(c.stop)
+	})
+}
+
+func (c *Coordinator) loop() {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.Sync()
+		case <-c.stop:
+			return
+		}
+	}
+}
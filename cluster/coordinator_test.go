@@ -0,0 +1,280 @@
+package cluster
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/benbjohnson/clock"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/wwqdrh/ratelimit"
+	"github.com/wwqdrh/ratelimit/registry"
+)
+
+// memRegistry 内存中的 registry，多个节点共享
+type memRegistry struct {
+	mu    sync.Mutex
+	nodes map[string]registry.NodeInfo
+}
+
+func newMemRegistry() *memRegistry {
+	return &memRegistry{nodes: map[string]registry.NodeInfo{}}
+}
+
+func (r *memRegistry) Initial(info registry.NodeInfo) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nodes[info.Addr] = info
+	return true
+}
+
+func (r *memRegistry) AllNodeInfo() []registry.NodeInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := []registry.NodeInfo{}
+	for _, val := range r.nodes {
+		res = append(res, val)
+	}
+	return res
+}
+
+func (r *memRegistry) Borrow(addr, target string, cap int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	from, ok1 := r.nodes[target]
+	to, ok2 := r.nodes[addr]
+	if !ok1 || !ok2 || from.Cap < cap {
+		return false
+	}
+	from.Cap -= cap
+	to.Cap += cap
+	r.nodes[target], r.nodes[addr] = from, to
+	return true
+}
+
+func (r *memRegistry) GetCap(addr string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if val, ok := r.nodes[addr]; ok {
+		return val.Cap
+	}
+	return -1
+}
+
+func (r *memRegistry) SetCap(addr string, cap int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if val, ok := r.nodes[addr]; ok {
+		val.Cap = cap
+		r.nodes[addr] = val
+		return true
+	}
+	return false
+}
+
+// expire 模拟节点挂掉之后过期
+func (r *memRegistry) expire(addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.nodes, addr)
+}
+
+func (r *memRegistry) totalCap() int {
+	total := 0
+	for _, node := range r.AllNodeInfo() {
+		total += node.Cap
+	}
+	return total
+}
+
+// newTestNodes 每个节点的桶每 10ms 补充一个令牌，时间由返回的 mock clock 控制
+func newTestNodes(reg registry.IRegistry, capacity int64, addrs []string, opts ...coordinatorOpt) ([]*Coordinator, *clock.Mock) {
+	mock := clock.NewMock()
+	opts = append([]coordinatorOpt{WithInterval(0), WithBorrowSize(10)}, opts...)
+	nodes := make([]*Coordinator, len(addrs))
+	for i, addr := range addrs {
+		nodes[i] = NewCoordinator(addr, reg, ratelimit.NewBucket(10*time.Millisecond, capacity, ratelimit.BucketWithClock(mock)), opts...)
+	}
+	syncAll(nodes)
+	return nodes, mock
+}
+
+func syncAll(nodes []*Coordinator) {
+	for _, node := range nodes {
+		node.Sync()
+	}
+}
+
+func allowed(c *Coordinator, n int) int {
+	count := 0
+	for i := 0; i < n; i++ {
+		if c.Allow() {
+			count++
+		}
+	}
+	return count
+}
+
+func TestCoordinatorBorrow(t *testing.T) {
+	reg := newMemRegistry()
+	nodes, clk := newTestNodes(reg, 100, []string{"app1", "app2"})
+	assert.Len(t, nodes[0].Nodes(), 2)
+
+	// 令牌用完之后借到的只是容量，不会多放行，一轮同步只借一次
+	assert.Equal(t, 100, allowed(nodes[0], 120))
+	assert.Equal(t, 110, reg.GetCap("app1"))
+	assert.Equal(t, 90, reg.GetCap("app2"))
+
+	// 补充的令牌可以存满借到的容量，被借走的节点同步之后桶缩小了
+	clk.Add(2 * time.Second)
+	syncAll(nodes)
+	assert.EqualValues(t, 110, nodes[0].Bucket().Capacity())
+	assert.EqualValues(t, 90, nodes[1].Bucket().Capacity())
+	assert.Equal(t, 110, allowed(nodes[0], 120))
+	assert.Equal(t, 90, allowed(nodes[1], 100))
+	assert.Equal(t, 200, reg.totalCap())
+}
+
+func TestCoordinatorBorrowStale(t *testing.T) {
+	reg := newMemRegistry()
+	nodes, _ := newTestNodes(reg, 100, []string{"app1", "app2"})
+
+	// app2 在同步之前已经把令牌用完了，app1 看到的还是旧的可用量，
+	// 借到的只是容量，整个集群仍然只放行 200 个
+	assert.Equal(t, 100, allowed(nodes[1], 100))
+	assert.Equal(t, 100, allowed(nodes[0], 110))
+	assert.Equal(t, 110, reg.GetCap("app1"))
+
+	syncAll(nodes)
+	assert.EqualValues(t, 90, nodes[1].Bucket().Capacity())
+	assert.EqualValues(t, 0, nodes[1].Bucket().Available())
+	assert.Equal(t, 0, allowed(nodes[0], 10))
+	assert.Equal(t, 0, allowed(nodes[1], 10))
+	assert.Equal(t, 200, reg.totalCap())
+}
+
+func TestCoordinatorTotal(t *testing.T) {
+	reg := newMemRegistry()
+	nodes, clk := newTestNodes(reg, 100, []string{"app1", "app2", "app3"}, WithTotal(300))
+
+	// 第一个节点拿到全部配额，后面的节点从 0 开始，借到容量之后等令牌补充
+	assert.Equal(t, 300, reg.GetCap("app1"))
+	assert.Equal(t, 0, reg.GetCap("app2"))
+	assert.Equal(t, 0, allowed(nodes[1], 10))
+	assert.Equal(t, 0, allowed(nodes[2], 10))
+	syncAll(nodes)
+	assert.Equal(t, 0, allowed(nodes[2], 10))
+	assert.Equal(t, 20, reg.GetCap("app3"))
+	clk.Add(time.Second)
+	assert.Equal(t, 10, allowed(nodes[1], 10))
+
+	// app3 挂掉之后容量由 app1 收回
+	nodes[2].Close()
+	reg.expire("app3")
+	syncAll(nodes[:2])
+	assert.Equal(t, 290, reg.GetCap("app1"))
+	assert.Equal(t, 300, reg.totalCap())
+}
+
+// brokenCapRegistry GetCap 失败时返回 -1
+type brokenCapRegistry struct {
+	*memRegistry
+	broken bool
+}
+
+func (r *brokenCapRegistry) GetCap(addr string) int {
+	if r.broken {
+		return -1
+	}
+	return r.memRegistry.GetCap(addr)
+}
+
+func TestCoordinatorBrokenCap(t *testing.T) {
+	reg := &brokenCapRegistry{memRegistry: newMemRegistry()}
+	nodes, _ := newTestNodes(reg, 100, []string{"app1"})
+
+	// GetCap 失败时不把 -1 写回去
+	reg.broken = true
+	syncAll(nodes)
+	reg.broken = false
+	assert.Equal(t, 100, reg.GetCap("app1"))
+
+	// 容量被改成负数时保留本地的容量，不能 panic
+	reg.SetCap("app1", -5)
+	assert.NotPanics(t, func() { syncAll(nodes) })
+	assert.EqualValues(t, 100, nodes[0].Bucket().Capacity())
+}
+
+// blockingRegistry AllNodeInfo 卡住直到 release 被关闭
+type blockingRegistry struct {
+	*memRegistry
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (r *blockingRegistry) AllNodeInfo() []registry.NodeInfo {
+	if r.release != nil {
+		r.entered <- struct{}{}
+		<-r.release
+	}
+	return r.memRegistry.AllNodeInfo()
+}
+
+func TestCoordinatorSyncUnlocked(t *testing.T) {
+	reg := &blockingRegistry{memRegistry: newMemRegistry()}
+	nodes, _ := newTestNodes(reg, 100, []string{"app1"})
+
+	// 同步卡在 registry 上时，请求不受影响
+	reg.entered, reg.release = make(chan struct{}), make(chan struct{})
+	synced := make(chan struct{})
+	go func() {
+		nodes[0].Sync()
+		close(synced)
+	}()
+	<-reg.entered
+	done := make(chan struct{})
+	go func() {
+		nodes[0].Nodes()
+		nodes[0].AllowN(200)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("request blocked by sync")
+	}
+	close(reg.release)
+	<-synced
+}
+
+func TestCoordinatorRedis(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	reg := registry.NewRedisRegistry(client)
+
+	nodes, _ := newTestNodes(reg, 100, []string{"app1", "app2"})
+	assert.Equal(t, 100, allowed(nodes[0], 150))
+	syncAll(nodes)
+
+	assert.Equal(t, 110, reg.GetCap("app1"))
+	assert.Equal(t, 90, reg.GetCap("app2"))
+	assert.ElementsMatch(t, []registry.NodeInfo{
+		{Addr: "app1", Cap: 110, Avaliable: 0},
+		{Addr: "app2", Cap: 90, Avaliable: 90},
+	}, reg.AllNodeInfo())
+}
+
+func TestCoordinatorBackground(t *testing.T) {
+	reg := newMemRegistry()
+	c1 := NewCoordinator("app1", reg, ratelimit.NewBucket(time.Hour, 100), WithInterval(10*time.Millisecond))
+	defer c1.Close()
+	c2 := NewCoordinator("app2", reg, ratelimit.NewBucket(time.Hour, 100), WithInterval(10*time.Millisecond))
+	defer c2.Close()
+
+	assert.Eventually(t, func() bool {
+		return len(c1.Nodes()) == 2
+	}, time.Second, 10*time.Millisecond)
+}
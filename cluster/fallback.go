@@ -0,0 +1,259 @@
+package cluster
+
+// 分布式限流的后端不可用时退回到本地限流
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/wwqdrh/ratelimit"
+	"github.com/wwqdrh/ratelimit/registry"
+)
+
+// Mode 当前使用哪个限流器
+type Mode int32
+
+const (
+	ModeRemote Mode = iota // 使用分布式限流器
+	ModeLocal              // 后端不可用，使用本地的令牌桶
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeRemote:
+		return "remote"
+	case ModeLocal:
+		return "local"
+	}
+	return "unknown"
+}
+
+// Fallback 包装一个分布式限流器，后端出错或者超时时改用本地的令牌桶
+//
+// 本地的令牌桶按已知的节点数缩小，所有节点加起来和分布式限流的配额差不多。
+// 连续失败 failThreshold 次之后切到本地，之后每隔 probeInterval 用一个请求探测后端，
+// 连续成功 recoverThreshold 次才切回去，避免后端时好时坏时来回切换
+type Fallback struct {
+	remote ratelimit.DistributedLimiter
+	nodes  func() []registry.NodeInfo
+	clock  ratelimit.Clock
+
+	fillInterval time.Duration
+	capacity     int64
+	quantum      int64
+
+	timeout          time.Duration
+	failThreshold    int
+	recoverThreshold int
+	probeInterval    time.Duration
+	nodesInterval    time.Duration
+
+	mu           sync.Mutex
+	mode         Mode
+	failures     int // 连续失败的次数
+	successes    int // 本地模式下连续探测成功的次数
+	lastProbe    time.Time
+	nodeCount    int
+	nodesUpdated time.Time
+	local        func(key string) ratelimit.Limiter // 本地的令牌桶
+}
+
+type fallbackOpt func(f *Fallback)
+
+// FallbackWithNodes 获取集群中所有节点的信息，比如 Coordinator.Nodes 或者 IRegistry.AllNodeInfo，
+// 后端正常时定期刷新，拿不到时使用上一次的节点数，默认为 1
+func FallbackWithNodes(nodes func() []registry.NodeInfo) fallbackOpt {
+	return func(f *Fallback) {
+		f.nodes = nodes
+	}
+}
+
+// FallbackWithTimeout 每次访问后端的超时时间，默认 100ms
+func FallbackWithTimeout(timeout time.Duration) fallbackOpt {
+	return func(f *Fallback) {
+		f.timeout = timeout
+	}
+}
+
+// FallbackWithThresholds 连续失败多少次切到本地，连续探测成功多少次切回去，默认 3 和 5
+func FallbackWithThresholds(fail, recover int) fallbackOpt {
+	return func(f *Fallback) {
+		f.failThreshold = fail
+		f.recoverThreshold = recover
+	}
+}
+
+// FallbackWithProbeInterval 本地模式下多久探测一次后端，默认 1 秒
+func FallbackWithProbeInterval(interval time.Duration) fallbackOpt {
+	return func(f *Fallback) {
+		f.probeInterval = interval
+	}
+}
+
+func FallbackWithClock(clock ratelimit.Clock) fallbackOpt {
+	return func(f *Fallback) {
+		f.clock = clock
+	}
+}
+
+// NewFallback 本地的令牌桶和 ratelimit.Bucket 一样每 fillInterval 放入 quantum 个令牌，最多存 capacity 个，
+// 使用时容量和放入速度都会除以节点数
+func NewFallback(remote ratelimit.DistributedLimiter, fillInterval time.Duration, capacity, quantum int64, opts ...fallbackOpt) *Fallback {
+	f := &Fallback{
+		remote:           remote,
+		fillInterval:     fillInterval,
+		capacity:         capacity,
+		quantum:          quantum,
+		timeout:          100 * time.Millisecond,
+		failThreshold:    3,
+		recoverThreshold: 5,
+		probeInterval:    time.Second,
+		nodesInterval:    10 * time.Second,
+		nodeCount:        1,
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	if f.clock == nil {
+		f.clock = clock.New()
+	}
+	if f.failThreshold <= 0 || f.recoverThreshold <= 0 {
+		panic("fallback thresholds are not > 0")
+	}
+	f.refreshNodes()
+	f.resetLocal()
+	return f
+}
+
+var _ ratelimit.DistributedLimiter = (*Fallback)(nil)
+
+// Mode 当前使用哪个限流器，可以用于监控
+func (f *Fallback) Mode() Mode {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.mode
+}
+
+// Throttle 后端出错时这一次也由本地的令牌桶决定，不会返回后端的错误
+func (f *Fallback) Throttle(ctx context.Context, key string, n int64) (ratelimit.Result, error) {
+	if !f.useRemote() {
+		return f.throttleLocal(key, n), nil
+	}
+
+	rctx, cancel := context.WithTimeout(ctx, f.timeout)
+	res, err := f.remote.Throttle(rctx, key, n)
+	cancel()
+	if err != nil && ctx.Err() != nil {
+		// 调用方自己取消了，不是后端的问题
+		return ratelimit.Result{}, ctx.Err()
+	}
+	f.report(err == nil)
+	if err != nil {
+		return f.throttleLocal(key, n), nil
+	}
+	f.maybeRefreshNodes()
+	return res, nil
+}
+
+// useRemote 本地模式下每隔 probeInterval 放一个请求去探测后端
+func (f *Fallback) useRemote() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.mode == ModeRemote {
+		return true
+	}
+	now := f.clock.Now()
+	if now.Sub(f.lastProbe) < f.probeInterval {
+		return false
+	}
+	f.lastProbe = now
+	return true
+}
+
+func (f *Fallback) report(ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch f.mode {
+	case ModeRemote:
+		if ok {
+			f.failures = 0
+			return
+		}
+		f.failures++
+		if f.failures >= f.failThreshold {
+			f.mode = ModeLocal
+			f.failures = 0
+			f.successes = 0
+			f.lastProbe = f.clock.Now()
+			f.resetLocalLocked()
+		}
+	case ModeLocal:
+		if !ok {
+			f.successes = 0
+			return
+		}
+		f.successes++
+		if f.successes >= f.recoverThreshold {
+			f.mode = ModeRemote
+			f.successes = 0
+		}
+	}
+}
+
+func (f *Fallback) throttleLocal(key string, n int64) ratelimit.Result {
+	f.mu.Lock()
+	local := f.local
+	f.mu.Unlock()
+	return ratelimit.Throttle(local(key), n)
+}
+
+func (f *Fallback) resetLocal() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.resetLocalLocked()
+}
+
+// resetLocalLocked 切到本地时按当前的节点数重新创建所有的桶，
+// 桶放在不启动后台协程的 MemoryStore 里，旧的那个不用 Close，没人引用之后被回收
+func (f *Fallback) resetLocalLocked() {
+	count := int64(f.nodeCount)
+	capacity := f.capacity / count
+	if capacity <= 0 {
+		capacity = 1
+	}
+	fillInterval, quantum := f.fillInterval*time.Duration(count), f.quantum
+	store := ratelimit.NewMemoryStore(ratelimit.StoreWithClock(f.clock), ratelimit.StoreWithInlineCleanup())
+	clk := f.clock
+	f.local = func(key string) ratelimit.Limiter {
+		return store.LoadOrStore(key, func() interface{} {
+			return ratelimit.NewBucket(fillInterval, capacity, ratelimit.BucketWithQuantum(quantum), ratelimit.BucketWithClock(clk))
+		}).(*ratelimit.Bucket)
+	}
+}
+
+func (f *Fallback) maybeRefreshNodes() {
+	f.mu.Lock()
+	due := f.nodes != nil && f.clock.Now().Sub(f.nodesUpdated) >= f.nodesInterval
+	if due {
+		f.nodesUpdated = f.clock.Now()
+	}
+	f.mu.Unlock()
+	if due {
+		f.refreshNodes()
+	}
+}
+
+func (f *Fallback) refreshNodes() {
+	if f.nodes == nil {
+		return
+	}
+	count := len(f.nodes())
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nodesUpdated = f.clock.Now()
+	if count > 0 {
+		f.nodeCount = count
+	}
+}
@@ -0,0 +1,114 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wwqdrh/ratelimit"
+	"github.com/wwqdrh/ratelimit/registry"
+)
+
+// testRemote 总是放行，down 时返回错误，slow 时一直等到 ctx 结束
+type testRemote struct {
+	down  int32
+	slow  int32
+	calls int64
+}
+
+func (r *testRemote) Throttle(ctx context.Context, key string, n int64) (ratelimit.Result, error) {
+	atomic.AddInt64(&r.calls, 1)
+	if atomic.LoadInt32(&r.slow) == 1 {
+		<-ctx.Done()
+		return ratelimit.Result{}, ctx.Err()
+	}
+	if atomic.LoadInt32(&r.down) == 1 {
+		return ratelimit.Result{}, errors.New("connection refused")
+	}
+	return ratelimit.Result{Allowed: true, Limit: 1000, Remaining: 999, RetryAfter: -1}, nil
+}
+
+func threeNodes() []registry.NodeInfo {
+	return []registry.NodeInfo{{Addr: "app1"}, {Addr: "app2"}, {Addr: "app3"}}
+}
+
+func throttleN(t *testing.T, f *Fallback, n int) (allowed int) {
+	for i := 0; i < n; i++ {
+		res, err := f.Throttle(context.Background(), "user1", 1)
+		require.NoError(t, err)
+		if res.Allowed {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+func TestFallback(t *testing.T) {
+	remote := &testRemote{}
+	mock := clock.NewMock()
+	f := NewFallback(remote, time.Hour, 30, 1,
+		FallbackWithClock(mock), FallbackWithNodes(threeNodes), FallbackWithThresholds(3, 2))
+	assert.Equal(t, ModeRemote, f.Mode())
+	assert.Equal(t, 20, throttleN(t, f, 20))
+
+	// 出错的请求由本地决定，连续失败 3 次之后不再访问后端
+	atomic.StoreInt32(&remote.down, 1)
+	remote.calls = 0
+	res, err := f.Throttle(context.Background(), "user1", 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), res.Limit)
+	assert.Equal(t, ModeRemote, f.Mode())
+	throttleN(t, f, 2)
+	assert.Equal(t, ModeLocal, f.Mode())
+	assert.EqualValues(t, 3, remote.calls)
+
+	// 本地的桶按节点数缩小到 30/3，触发切换的那个请求已经用掉了一个
+	assert.Equal(t, 9, throttleN(t, f, 20))
+	assert.EqualValues(t, 3, remote.calls)
+
+	// 探测失败，继续使用本地
+	mock.Add(time.Second)
+	throttleN(t, f, 1)
+	assert.EqualValues(t, 4, remote.calls)
+	assert.Equal(t, ModeLocal, f.Mode())
+
+	// 连续两次探测成功之后才切回去
+	atomic.StoreInt32(&remote.down, 0)
+	mock.Add(time.Second)
+	assert.Equal(t, 1, throttleN(t, f, 5))
+	assert.Equal(t, ModeLocal, f.Mode())
+	mock.Add(time.Second)
+	assert.Equal(t, 1, throttleN(t, f, 1))
+	assert.Equal(t, ModeRemote, f.Mode())
+	assert.Equal(t, 5, throttleN(t, f, 5))
+	assert.EqualValues(t, 11, remote.calls)
+}
+
+func TestFallbackTimeout(t *testing.T) {
+	remote := &testRemote{slow: 1}
+	f := NewFallback(remote, time.Hour, 10, 1, FallbackWithTimeout(10*time.Millisecond), FallbackWithThresholds(1, 1))
+
+	start := time.Now()
+	res, err := f.Throttle(context.Background(), "user1", 1)
+	require.NoError(t, err)
+	assert.True(t, res.Allowed)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, ModeLocal, f.Mode())
+	assert.Equal(t, "local", f.Mode().String())
+}
+
+func TestFallbackCallerCanceled(t *testing.T) {
+	remote := &testRemote{slow: 1}
+	f := NewFallback(remote, time.Hour, 10, 1, FallbackWithTimeout(time.Hour), FallbackWithThresholds(1, 1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := f.Throttle(ctx, "user1", 1)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, ModeRemote, f.Mode())
+}
@@ -0,0 +1,151 @@
+package ratelimit
+
+// 并发数限制
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// a base wrapper
+type concurrencyStore struct {
+	limit int64
+
+	data Store
+}
+
+// if not exist, create
+func (m *concurrencyStore) GetLimiter(key string) *ConcurrencyLimiter {
+	return m.data.LoadOrStore(key, func() interface{} {
+		return NewConcurrencyLimiter(m.limit)
+	}).(*ConcurrencyLimiter)
+}
+
+// ConcurrencyLimiter 信号量，同时最多 limit 个请求在处理，
+// 等待的请求按先来后到的顺序拿到许可
+type ConcurrencyLimiter struct {
+	mu       sync.Mutex
+	limit    int64
+	inflight int64
+	waiters  list.List // chan struct{}，拿到许可时关闭
+}
+
+// NewConcurrencyLimiter 同时最多 limit 个请求
+func NewConcurrencyLimiter(limit int64) *ConcurrencyLimiter {
+	if limit <= 0 {
+		panic("concurrency limit is not > 0")
+	}
+	return &ConcurrencyLimiter{limit: limit}
+}
+
+// TryAcquire 不等待，拿不到许可直接返回 false
+func (c *ConcurrencyLimiter) TryAcquire() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inflight < c.limit && c.waiters.Len() == 0 {
+		c.inflight++
+		return true
+	}
+	return false
+}
+
+// Acquire 等待直到拿到许可，ctx 被取消时返回错误
+func (c *ConcurrencyLimiter) Acquire(ctx context.Context) error {
+	return c.acquire(ctx, nil, infinityDuration)
+}
+
+// acquire 最多按 clock 等 maxWait，超时返回 context.DeadlineExceeded
+func (c *ConcurrencyLimiter) acquire(ctx context.Context, clock Clock, maxWait time.Duration) error {
+	c.mu.Lock()
+	if c.inflight < c.limit && c.waiters.Len() == 0 {
+		c.inflight++
+		c.mu.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	elem := c.waiters.PushBack(ready)
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if maxWait < infinityDuration {
+		timeout = clock.After(maxWait)
+	}
+	var err error
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timeout:
+		err = context.DeadlineExceeded
+	}
+	c.mu.Lock()
+	select {
+	case <-ready:
+		// 放弃的同时拿到了许可，还回去
+		c.mu.Unlock()
+		c.Release()
+	default:
+		c.waiters.Remove(elem)
+		// 排在队首的请求离开了，后面的请求可能可以拿到许可
+		c.notifyWaiters()
+		c.mu.Unlock()
+	}
+	return err
+}
+
+// Release 归还一个许可，每次成功的 Acquire 或者 TryAcquire 都要对应一次 Release
+func (c *ConcurrencyLimiter) Release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inflight <= 0 {
+		panic("concurrency limiter released more than acquired")
+	}
+	c.inflight--
+	c.notifyWaiters()
+}
+
+// notifyWaiters 按顺序把空出来的许可交给等待的请求，调用前需要持有锁
+func (c *ConcurrencyLimiter) notifyWaiters() {
+	for c.inflight < c.limit {
+		front := c.waiters.Front()
+		if front == nil {
+			return
+		}
+		c.inflight++
+		close(c.waiters.Remove(front).(chan struct{}))
+	}
+}
+
+// Inflight 正在处理的请求数
+func (c *ConcurrencyLimiter) Inflight() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.inflight
+}
+
+func (c *ConcurrencyLimiter) Limit() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.limit
+}
+
+// SetLimit 调整并发数，调小时已经在处理的请求不受影响，等它们结束之后才会放行新的请求
+func (c *ConcurrencyLimiter) SetLimit(limit int64) {
+	if limit <= 0 {
+		panic("concurrency limit is not > 0")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.limit = limit
+	c.notifyWaiters()
+}
+
+// Idle 没有请求在处理也没有请求在等待
+func (c *ConcurrencyLimiter) Idle() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.inflight == 0 && c.waiters.Len() == 0
+}
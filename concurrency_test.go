@@ -0,0 +1,178 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// waitForWaiters 等到有 n 个请求在排队
+func waitForWaiters(c *ConcurrencyLimiter, n int) {
+	for {
+		c.mu.Lock()
+		l := c.waiters.Len()
+		c.mu.Unlock()
+		if l >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	c := NewConcurrencyLimiter(2)
+	assert.True(t, c.TryAcquire())
+	assert.True(t, c.TryAcquire())
+	assert.False(t, c.TryAcquire())
+	assert.Equal(t, int64(2), c.Inflight())
+
+	acquired := make(chan int, 2)
+	for i := 1; i <= 2; i++ {
+		go func(i int) {
+			assert.NoError(t, c.Acquire(context.Background()))
+			acquired <- i
+		}(i)
+		waitForWaiters(c, i)
+	}
+
+	// 先来先得
+	c.Release()
+	assert.Equal(t, 1, <-acquired)
+	// 有人在排队时 TryAcquire 不能插队
+	assert.False(t, c.TryAcquire())
+	c.Release()
+	assert.Equal(t, 2, <-acquired)
+
+	c.Release()
+	c.Release()
+	assert.True(t, c.Idle())
+	assert.Panics(t, c.Release)
+}
+
+func TestConcurrencyLimiterAcquireCancel(t *testing.T) {
+	c := NewConcurrencyLimiter(1)
+	assert.NoError(t, c.Acquire(context.Background()))
+
+	clk := newNotifyClock()
+	go func() {
+		<-clk.after
+		clk.Add(10 * time.Millisecond)
+	}()
+	assert.ErrorIs(t, c.acquire(context.Background(), clk, 10*time.Millisecond), context.DeadlineExceeded)
+	assert.False(t, c.Idle())
+
+	// 取消的请求不占位置
+	c.Release()
+	assert.True(t, c.Idle())
+	assert.True(t, c.TryAcquire())
+}
+
+func TestConcurrencyLimiterSetLimit(t *testing.T) {
+	c := NewConcurrencyLimiter(1)
+	assert.True(t, c.TryAcquire())
+
+	done := make(chan struct{})
+	go func() {
+		assert.NoError(t, c.Acquire(context.Background()))
+		close(done)
+	}()
+	waitForWaiters(c, 1)
+	c.SetLimit(2)
+	<-done
+	assert.Equal(t, int64(2), c.Inflight())
+
+	c.SetLimit(1)
+	c.Release()
+	assert.False(t, c.TryAcquire())
+	c.Release()
+	assert.True(t, c.TryAcquire())
+}
+
+func TestConcurrencyMiddleware(t *testing.T) {
+	started, block := make(chan struct{}), make(chan struct{})
+	h := ConcurrencyMiddleware(1, MiddlewareWithMaxWait(0), MiddlewareWithKeyFunc(KeyByHeader("X-User")))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/block":
+				started <- struct{}{}
+				<-block
+			case "/panic":
+				panic("boom")
+			}
+		}))
+	user := map[string]string{"X-User": "1"}
+
+	done := make(chan int)
+	go func() { done <- doRequest(h, "/block", user) }()
+	<-started
+	assert.Equal(t, http.StatusTooManyRequests, doRequest(h, "/user/1", user))
+	assert.Equal(t, http.StatusOK, doRequest(h, "/user/1", map[string]string{"X-User": "2"}))
+	close(block)
+	assert.Equal(t, http.StatusOK, <-done)
+
+	// panic 之后许可也还回去了
+	assert.Panics(t, func() { doRequest(h, "/panic", user) })
+	assert.Equal(t, http.StatusOK, doRequest(h, "/user/1", user))
+}
+
+func TestConcurrencyMiddlewareMaxWait(t *testing.T) {
+	clk := newNotifyClock()
+	started, block := make(chan struct{}), make(chan struct{})
+	h := ConcurrencyMiddleware(1, MiddlewareWithMaxWait(50*time.Millisecond), MiddlewareWithMaxQueue(1), MiddlewareWithClock(clk))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/block" {
+				started <- struct{}{}
+				<-block
+			}
+		}))
+
+	done := make(chan int)
+	go func() { done <- doRequest(h, "/block", nil) }()
+	<-started
+	// 等不到许可
+	timeout := make(chan int)
+	go func() { timeout <- doRequest(h, "/block", nil) }()
+	<-clk.after
+	clk.Add(50 * time.Millisecond)
+	assert.Equal(t, http.StatusTooManyRequests, <-timeout)
+
+	queued := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/block", nil))
+		queued <- w.Code
+	}()
+	<-clk.after
+	// 排队的人太多
+	assert.Equal(t, http.StatusTooManyRequests, doRequest(h, "/block", nil))
+	block <- struct{}{}
+	assert.Equal(t, http.StatusOK, <-done)
+	<-started
+	close(block)
+	assert.Equal(t, http.StatusOK, <-queued)
+}
+
+func TestConcurrencyLimitersNotEvictedWhileInflight(t *testing.T) {
+	store, clk := newTestStore(StoreWithMaxEntries(2))
+	limiters := &concurrencyStore{limit: 1, data: store}
+	held := limiters.GetLimiter("held")
+	assert.True(t, held.TryAcquire())
+
+	for _, key := range []string{"a", "b", "c"} {
+		limiters.GetLimiter(key)
+	}
+	// 还有许可没有归还，丢掉的话同一个 key 的并发数就翻倍了
+	assert.Same(t, held, limiters.GetLimiter("held"))
+	assert.False(t, limiters.GetLimiter("held").TryAcquire())
+
+	held.Release()
+	for _, key := range []string{"d", "e", "f"} {
+		clk.Add(time.Second)
+		limiters.GetLimiter(key)
+	}
+	assert.NotSame(t, held, limiters.GetLimiter("held"))
+}
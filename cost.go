@@ -0,0 +1,77 @@
+package ratelimit
+
+// 请求的代价，一个请求消耗多少个令牌
+
+import (
+	"context"
+	"net/http"
+)
+
+// CostFunc 计算一个请求消耗多少个令牌，返回 0 时这次请求不消耗额度
+type CostFunc func(r *http.Request) (int64, error)
+
+// MiddlewareWithCost 按 cost 计算每个请求消耗的令牌数，默认每个请求消耗 1 个
+func MiddlewareWithCost(cost CostFunc) MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.costFunc = cost
+	}
+}
+
+type costContextKey struct{}
+
+// ContextWithCost 前面的中间件或者路由指定这次请求的代价，配合 CostByContext 使用
+func ContextWithCost(ctx context.Context, cost int64) context.Context {
+	return context.WithValue(ctx, costContextKey{}, cost)
+}
+
+// CostByContext 使用 ContextWithCost 保存的代价，没有设置时为 def
+func CostByContext(def int64) CostFunc {
+	return func(r *http.Request) (int64, error) {
+		if cost, ok := r.Context().Value(costContextKey{}).(int64); ok {
+			return cost, nil
+		}
+		return def, nil
+	}
+}
+
+// CostByPath 按请求路径查表，没有匹配的路径时为 def
+func CostByPath(costs map[string]int64, def int64) CostFunc {
+	return func(r *http.Request) (int64, error) {
+		if cost, ok := costs[r.URL.Path]; ok {
+			return cost, nil
+		}
+		return def, nil
+	}
+}
+
+// CostByBodySize 每 bytesPerToken 字节的请求体消耗一个令牌，向上取整，最少消耗 1 个
+// 不知道请求体大小(chunked)时也只消耗 1 个
+func CostByBodySize(bytesPerToken int64) CostFunc {
+	if bytesPerToken <= 0 {
+		panic("ratelimit: bytes per token is not > 0")
+	}
+	return func(r *http.Request) (int64, error) {
+		if r.ContentLength <= bytesPerToken {
+			return 1, nil
+		}
+		return (r.ContentLength + bytesPerToken - 1) / bytesPerToken, nil
+	}
+}
+
+// requestCost 计算请求的代价，ok 为 false 时请求已经处理完了(不消耗额度直接放行或者出错)
+// 和 limitKey 一样，出错时交给 errHandler
+func requestCost(w http.ResponseWriter, r *http.Request, conf middlewareConfig, next http.Handler) (int64, bool) {
+	if conf.costFunc == nil {
+		return 1, true
+	}
+	cost, err := conf.costFunc(r)
+	if err != nil {
+		conf.errHandler(w, r, err)
+		return 0, false
+	}
+	if cost <= 0 {
+		next.ServeHTTP(w, r)
+		return 0, false
+	}
+	return cost, true
+}
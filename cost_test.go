@@ -0,0 +1,89 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCostFuncs(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/export", strings.NewReader(strings.Repeat("x", 2500)))
+
+	cost, _ := CostByBodySize(1000)(r)
+	assert.Equal(t, int64(3), cost)
+	cost, _ = CostByBodySize(1000)(httptest.NewRequest(http.MethodGet, "/user/1", nil))
+	assert.Equal(t, int64(1), cost)
+
+	byPath := CostByPath(map[string]int64{"/export": 100}, 1)
+	cost, _ = byPath(r)
+	assert.Equal(t, int64(100), cost)
+	cost, _ = byPath(httptest.NewRequest(http.MethodGet, "/user/1", nil))
+	assert.Equal(t, int64(1), cost)
+
+	cost, _ = CostByContext(1)(r)
+	assert.Equal(t, int64(1), cost)
+	cost, _ = CostByContext(1)(r.WithContext(ContextWithCost(r.Context(), 7)))
+	assert.Equal(t, int64(7), cost)
+}
+
+func TestTokenBucketCost(t *testing.T) {
+	h := newTestHandler(TokenBucketMiddleware(time.Hour, 10, 1,
+		MiddlewareWithCost(CostByPath(map[string]int64{"/export": 8, "/health": 0}, 1))))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/export", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2", w.Header().Get(HeaderXRateLimitRemaining))
+
+	// 每个路径一个桶，同一个桶里剩下的令牌不够再导出一次
+	assert.Equal(t, http.StatusTooManyRequests, doRequest(h, "/export", nil))
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, doRequest(h, "/health", nil))
+	}
+}
+
+func TestLeakyBucketCost(t *testing.T) {
+	clk := clock.NewMock()
+	clk.Set(time.Now())
+	h := newTestHandler(LeakyBucketMiddleware(10, MiddlewareWithClock(clk),
+		MiddlewareWithCost(CostByContext(1)), MiddlewareWithMaxWait(50*time.Millisecond)))
+	do := func(cost int64) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/user/1", nil)
+		h.ServeHTTP(w, r.WithContext(ContextWithCost(context.Background(), cost)))
+		return w.Code
+	}
+
+	// 5 个许可的最后一个要 400ms 之后才发放
+	assert.Equal(t, http.StatusTooManyRequests, do(5))
+	// 被拒绝的请求一个许可都不占
+	assert.Equal(t, http.StatusOK, do(1))
+	assert.Equal(t, http.StatusTooManyRequests, do(1))
+	clk.Add(100 * time.Millisecond)
+	assert.Equal(t, http.StatusOK, do(1))
+}
+
+func TestCostFuncError(t *testing.T) {
+	var got error
+	h := newTestHandler(TokenBucketMiddleware(time.Hour, 10, 1,
+		MiddlewareWithCost(func(r *http.Request) (int64, error) {
+			return 0, errors.New("bad cost")
+		}),
+		MiddlewareWithErrorHandler(func(w http.ResponseWriter, r *http.Request, err error) {
+			got = err
+			DefaultErrorHandler(w, r, err)
+		})))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/export", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.NotContains(t, w.Body.String(), "bad cost")
+	assert.EqualError(t, got, "bad cost")
+}
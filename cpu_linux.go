@@ -0,0 +1,86 @@
+//go:build linux
+// +build linux
+
+package ratelimit
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// userHZ /proc 中 CPU 时间的单位，linux 上几乎都是 100
+const userHZ = 100
+
+// processCPUTime 进程已经使用的 CPU 时间，读取 /proc/self/stat 中的 utime 和 stime
+func processCPUTime() (time.Duration, error) {
+	data, err := os.ReadFile("/proc/self/stat")
+	if err != nil {
+		return 0, err
+	}
+	// 进程名可能包含空格，从最后一个 ')' 之后开始解析，第一个字段是 state
+	i := bytes.LastIndexByte(data, ')')
+	if i < 0 {
+		return 0, errors.New("ratelimit: malformed /proc/self/stat")
+	}
+	fields := bytes.Fields(data[i+1:])
+	if len(fields) < 13 {
+		return 0, errors.New("ratelimit: malformed /proc/self/stat")
+	}
+	utime, err := strconv.ParseInt(string(fields[11]), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	stime, err := strconv.ParseInt(string(fields[12]), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(utime+stime) * time.Second / userHZ, nil
+}
+
+// cgroupRoot cgroup 的挂载点，容器里看到的就是自己的 cgroup
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupCPUQuota cgroup 限制的 CPU 核数，没有限制时返回 false
+func cgroupCPUQuota() (float64, bool) {
+	return readCPUQuota(cgroupRoot)
+}
+
+// readCPUQuota 先读 cgroup v2 的 cpu.max("max 100000" 或者 "200000 100000")，
+// 再读 v1 的 cpu.cfs_quota_us 和 cpu.cfs_period_us，quota 为 -1 表示不限制
+func readCPUQuota(root string) (float64, bool) {
+	if data, err := os.ReadFile(filepath.Join(root, "cpu.max")); err == nil {
+		fields := bytes.Fields(data)
+		if len(fields) != 2 || string(fields[0]) == "max" {
+			return 0, false
+		}
+		return cpuQuota(string(fields[0]), string(fields[1]))
+	}
+	for _, dir := range []string{"cpu", "cpu,cpuacct"} {
+		quota, err := os.ReadFile(filepath.Join(root, dir, "cpu.cfs_quota_us"))
+		if err != nil {
+			continue
+		}
+		period, err := os.ReadFile(filepath.Join(root, dir, "cpu.cfs_period_us"))
+		if err != nil {
+			continue
+		}
+		return cpuQuota(string(bytes.TrimSpace(quota)), string(bytes.TrimSpace(period)))
+	}
+	return 0, false
+}
+
+func cpuQuota(quota, period string) (float64, bool) {
+	q, err := strconv.ParseInt(quota, 10, 64)
+	if err != nil || q <= 0 {
+		return 0, false
+	}
+	p, err := strconv.ParseInt(period, 10, 64)
+	if err != nil || p <= 0 {
+		return 0, false
+	}
+	return float64(q) / float64(p), true
+}
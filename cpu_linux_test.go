@@ -0,0 +1,44 @@
+//go:build linux
+// +build linux
+
+package ratelimit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadCPUQuota(t *testing.T) {
+	write := func(t *testing.T, root, name, content string) {
+		path := filepath.Join(root, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+
+	for _, tt := range []struct {
+		about string
+		files map[string]string
+		quota float64
+		ok    bool
+	}{
+		{"no cgroup", nil, 0, false},
+		{"v2", map[string]string{"cpu.max": "150000 100000\n"}, 1.5, true},
+		{"v2 unlimited", map[string]string{"cpu.max": "max 100000\n"}, 0, false},
+		{"v1", map[string]string{"cpu/cpu.cfs_quota_us": "50000\n", "cpu/cpu.cfs_period_us": "100000\n"}, 0.5, true},
+		{"v1 cpuacct", map[string]string{"cpu,cpuacct/cpu.cfs_quota_us": "200000\n", "cpu,cpuacct/cpu.cfs_period_us": "100000\n"}, 2, true},
+		{"v1 unlimited", map[string]string{"cpu/cpu.cfs_quota_us": "-1\n", "cpu/cpu.cfs_period_us": "100000\n"}, 0, false},
+	} {
+		t.Run(tt.about, func(t *testing.T) {
+			root := t.TempDir()
+			for name, content := range tt.files {
+				write(t, root, name, content)
+			}
+			quota, ok := readCPUQuota(root)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.quota, quota)
+		})
+	}
+}
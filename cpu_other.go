@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package ratelimit
+
+import (
+	"errors"
+	"time"
+)
+
+// processCPUTime 只支持 linux，其他系统需要通过 BBRWithCPU 提供 CPU 使用率
+func processCPUTime() (time.Duration, error) {
+	return 0, errors.New("ratelimit: process cpu time is only supported on linux")
+}
+
+// cgroupCPUQuota 只有 linux 有 cgroup
+func cgroupCPUQuota() (float64, bool) {
+	return 0, false
+}
@@ -0,0 +1,241 @@
+package ratelimit
+
+// 固定窗口计数器实现
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type fixedWindow struct {
+	limit  int64
+	window time.Duration
+	clock  Clock // 为 nil 时使用真实的时间
+
+	data Store
+}
+
+// if not exist, create
+func (m *fixedWindow) GetWindow(key string) *FixedWindow {
+	return m.data.LoadOrStore(key, func() interface{} {
+		return NewFixedWindow(m.limit, m.window, WindowWithClock(m.clock))
+	}).(*FixedWindow)
+}
+
+// FixedWindow 每个窗口内最多通过 limit 个请求，窗口按 unix 时间对齐
+//
+// Allow 只使用当前窗口的额度；Reserve 和 Wait 在当前窗口用完后会顺延到之后的窗口，
+// 所以 used 可能大于 limit，每跨过一个窗口就减掉 limit
+type FixedWindow struct {
+	clock Clock
+
+	limit  int64
+	window time.Duration
+
+	mu      sync.Mutex // 只在切换窗口时使用
+	current int64      // 当前窗口的序号
+	used    int64      // 当前窗口以及顺延到之后窗口的计数
+}
+
+// 窗口类算法共用的选项
+type windowConfig struct {
+	clock Clock
+}
+
+type windowOpt func(c *windowConfig)
+
+func WindowWithClock(clock Clock) windowOpt {
+	return func(c *windowConfig) {
+		if clock == nil {
+			clock = realClock{}
+		}
+		c.clock = clock
+	}
+}
+
+func newWindowConfig(opts ...windowOpt) windowConfig {
+	c := windowConfig{clock: realClock{}}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+func NewFixedWindow(limit int64, window time.Duration, opts ...windowOpt) *FixedWindow {
+	if limit <= 0 {
+		panic("fixed window limit is not > 0")
+	}
+	if window <= 0 {
+		panic("fixed window length is not > 0")
+	}
+	w := &FixedWindow{
+		clock:  newWindowConfig(opts...).clock,
+		limit:  limit,
+		window: window,
+	}
+	w.current = w.windowIndex(w.clock.Now())
+	return w
+}
+
+func (w *FixedWindow) Allow() bool {
+	return w.AllowN(1)
+}
+
+func (w *FixedWindow) AllowN(n int64) bool {
+	return w.reserveN(n, 0).ok
+}
+
+func (w *FixedWindow) Reserve() *Reservation {
+	return w.ReserveN(1)
+}
+
+func (w *FixedWindow) ReserveN(n int64) *Reservation {
+	return w.reserveN(n, infinityDuration)
+}
+
+func (w *FixedWindow) ReserveMaxDuration(n int64, maxWait time.Duration) *Reservation {
+	return w.reserveN(n, maxWait)
+}
+
+func (w *FixedWindow) Wait() error {
+	return w.WaitN(1)
+}
+
+func (w *FixedWindow) WaitN(n int64) error {
+	rv := w.ReserveN(n)
+	if !rv.OK() {
+		return ErrExceedsLimit
+	}
+	if d := rv.Delay(); d > 0 {
+		w.clock.Sleep(d)
+	}
+	return nil
+}
+
+func (w *FixedWindow) WaitContext(ctx context.Context, n int64) error {
+	maxWait, err := waitBudget(ctx, w.clock)
+	if err != nil {
+		return err
+	}
+	return w.reserveN(n, maxWait).Wait(ctx)
+}
+
+// Available 当前窗口剩余的额度
+func (w *FixedWindow) Available() int64 {
+	w.advance(w.windowIndex(w.clock.Now()))
+	if avail := w.limit - atomic.LoadInt64(&w.used); avail > 0 {
+		return avail
+	}
+	return 0
+}
+
+func (w *FixedWindow) reserveN(n int64, maxWait time.Duration) *Reservation {
+	now := w.clock.Now()
+	r := &Reservation{clock: w.clock}
+	if n <= 0 {
+		r.ok = true
+		r.timeToAct = now
+		return r
+	}
+	if n > w.limit {
+		return r
+	}
+
+	idx := w.advance(w.windowIndex(now))
+	for {
+		used := atomic.LoadInt64(&w.used)
+		next := used + n
+		// 超出当前窗口的部分依次落到之后的窗口
+		slot := idx + (next-1)/w.limit
+		timeToAct := now
+		if slot > idx {
+			timeToAct = time.Unix(0, slot*int64(w.window))
+		}
+		if timeToAct.Sub(now) > maxWait {
+			r.timeToAct = timeToAct
+			return r
+		}
+		if atomic.CompareAndSwapInt64(&w.used, used, next) {
+			r.ok = true
+			r.timeToAct = timeToAct
+			r.cancel = func() { w.cancel(n, idx, next, timeToAct) }
+			return r
+		}
+	}
+}
+
+// cancel 只有这次预留仍然是最后一个时才回退，idx 和 next 为预留时的窗口序号和计数，
+// 否则后面的预留已经排在它之后，回退会让之后的预留和它们落在同一个窗口里
+func (w *FixedWindow) cancel(n, idx, next int64, timeToAct time.Time) {
+	now := w.clock.Now()
+	if !timeToAct.After(now) {
+		return
+	}
+	// 之后每跨过一个窗口计数减掉 limit，预留的许可还没到时间，不会被清零
+	cur := w.advance(w.windowIndex(now))
+	last := next - (cur-idx)*w.limit
+	atomic.CompareAndSwapInt64(&w.used, last, last-n)
+}
+
+func (w *FixedWindow) windowIndex(now time.Time) int64 {
+	return now.UnixNano() / int64(w.window)
+}
+
+// Throttle 尝试在当前窗口拿 n 个许可，ResetAfter 为到下一个窗口的时间
+func (w *FixedWindow) Throttle(n int64) Result {
+	r := w.reserveN(n, 0)
+	now := w.clock.Now()
+	idx := w.advance(w.windowIndex(now))
+	used := atomic.LoadInt64(&w.used)
+	res := Result{
+		Allowed:    r.ok,
+		Limit:      w.limit,
+		RetryAfter: -1,
+		ResetAfter: time.Unix(0, (idx+1)*int64(w.window)).Sub(now),
+	}
+	if used < w.limit {
+		res.Remaining = w.limit - used
+	}
+	if !r.ok && n <= w.limit {
+		slot := idx + (used+n-1)/w.limit
+		res.RetryAfter = time.Unix(0, slot*int64(w.window)).Sub(now)
+	}
+	return res
+}
+
+// Idle 计数已经清零
+func (w *FixedWindow) Idle() bool {
+	w.advance(w.windowIndex(w.clock.Now()))
+	return atomic.LoadInt64(&w.used) == 0
+}
+
+// advance 切换到 idx 对应的窗口，每跨过一个窗口释放 limit 个计数
+// 快路径只有一次原子读
+func (w *FixedWindow) advance(idx int64) int64 {
+	cur := atomic.LoadInt64(&w.current)
+	if idx <= cur {
+		return cur
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	cur = atomic.LoadInt64(&w.current)
+	if idx <= cur {
+		return cur
+	}
+	windows := idx - cur
+	for {
+		used := atomic.LoadInt64(&w.used)
+		next := int64(0)
+		if windows <= used/w.limit {
+			next = used - windows*w.limit
+		}
+		if atomic.CompareAndSwapInt64(&w.used, used, next) {
+			break
+		}
+	}
+	atomic.StoreInt64(&w.current, idx)
+	return idx
+}
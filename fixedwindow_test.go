@@ -0,0 +1,102 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestFixedWindow(limit int64, window time.Duration) (*FixedWindow, *clock.Mock) {
+	clk := clock.NewMock()
+	// align to the start of a window
+	clk.Set(time.Unix(0, 0).Add(1000 * window))
+	return NewFixedWindow(limit, window, WindowWithClock(clk)), clk
+}
+
+func TestFixedWindowAllow(t *testing.T) {
+	w, clk := newTestFixedWindow(3, time.Minute)
+
+	assert.True(t, w.AllowN(2))
+	assert.True(t, w.Allow())
+	assert.False(t, w.Allow())
+	assert.Equal(t, int64(0), w.Available())
+
+	// still the same window
+	clk.Add(59 * time.Second)
+	assert.False(t, w.Allow())
+
+	clk.Add(time.Second)
+	assert.Equal(t, int64(3), w.Available())
+	assert.False(t, w.AllowN(4))
+	assert.True(t, w.AllowN(3))
+}
+
+func TestFixedWindowReserve(t *testing.T) {
+	w, clk := newTestFixedWindow(2, time.Minute)
+
+	assert.True(t, w.AllowN(2))
+	r1 := w.Reserve()
+	assert.True(t, r1.OK())
+	assert.Equal(t, time.Minute, r1.Delay())
+
+	r2 := w.ReserveN(2)
+	assert.True(t, r2.OK())
+	assert.Equal(t, 2*time.Minute, r2.Delay())
+
+	assert.False(t, w.ReserveN(3).OK())
+
+	// giving r2 back frees its slots in the following windows
+	r2.Cancel()
+	clk.Add(time.Minute)
+	assert.Equal(t, int64(1), w.Available())
+	clk.Add(time.Minute)
+	assert.Equal(t, int64(2), w.Available())
+}
+
+func TestFixedWindowWaitNExceedsLimit(t *testing.T) {
+	w, _ := newTestFixedWindow(2, time.Second)
+	assert.ErrorIs(t, w.WaitN(5), ErrExceedsLimit)
+	assert.NoError(t, w.WaitN(2))
+}
+
+func TestFixedWindowCancelKeepsLaterReservations(t *testing.T) {
+	w, clk := newTestFixedWindow(2, time.Second)
+	rs := make([]*Reservation, 5)
+	for i := range rs {
+		rs[i] = w.Reserve()
+	}
+	assert.Equal(t, 2*time.Second, rs[4].Delay())
+
+	// r3 后面还有预留，不能回退，否则 r6 会和 r5 落在同一个窗口
+	rs[2].Cancel()
+	assert.Equal(t, 2*time.Second, w.Reserve().Delay())
+	clk.Add(time.Second)
+	assert.Equal(t, 2*time.Second, w.Reserve().Delay())
+
+	// 最后一个预留可以回退
+	r := w.Reserve()
+	assert.Equal(t, 2*time.Second, r.Delay())
+	r.Cancel()
+	assert.Equal(t, 2*time.Second, w.Reserve().Delay())
+}
+
+func TestFixedWindowWaitContext(t *testing.T) {
+	w, clk := newTestFixedWindow(1, time.Minute)
+
+	assert.NoError(t, w.WaitContext(context.Background(), 1))
+
+	ctx := withMockDeadline(clk, 10*time.Millisecond)
+	assert.ErrorIs(t, w.WaitContext(ctx, 1), context.DeadlineExceeded)
+
+	clk.Add(time.Minute)
+	assert.True(t, w.Allow())
+}
+
+func TestFixedWindowStore(t *testing.T) {
+	counter := &fixedWindow{limit: 1, window: time.Minute, data: NewMemoryStore(StoreWithCleanupInterval(0))}
+	assert.Same(t, counter.GetWindow("a"), counter.GetWindow("a"))
+	assert.NotSame(t, counter.GetWindow("a"), counter.GetWindow("b"))
+}
@@ -0,0 +1,197 @@
+package ratelimit
+
+// GCRA(generic cell rate algorithm) 实现
+//
+// 和 atomicInt64Limiter 一样只用一个 int64 保存理论到达时间(TAT)，
+// 不同的是拿不到许可时直接拒绝并给出重试时间，语义和 redis-cell 的 CL.THROTTLE 保持一致
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+type gcraStore struct {
+	rate  int
+	burst int
+	per   time.Duration
+	clock Clock // 为 nil 时使用真实的时间
+
+	data Store
+}
+
+// if not exist, create
+func (m *gcraStore) GetGCRA(key string) *GCRA {
+	return m.data.LoadOrStore(key, func() interface{} {
+		return NewGCRA(m.rate, WithSlack(m.burst), WithPer(m.per), WithClock(m.clock))
+	}).(*GCRA)
+}
+
+// GCRA 每 per 时间内放行 rate 个请求，并允许 slack 个请求的突发
+// 对应 CL.THROTTLE key slack rate per
+type GCRA struct {
+	//lint:ignore U1000 Padding is unused but it is crucial to maintain performance
+	// of this rate limiter in case of collocation with other frequently accessed memory.
+	prepadding [64]byte //nolint:structcheck
+	tat        int64    // unix nanoseconds of the theoretical arrival time, 0 means empty
+	//lint:ignore U1000 like prepadding.
+	postpadding [56]byte //nolint:structcheck
+
+	emissionInterval time.Duration // 两个请求之间的理论间隔
+	tolerance        time.Duration // 允许提前到达的时间，emissionInterval * (slack + 1)
+	limit            int64
+	clock            Clock
+}
+
+func NewGCRA(rate int, opts ...leakOption) *GCRA {
+	if rate <= 0 {
+		panic("gcra rate is not > 0")
+	}
+	config := NewConfig(rate, opts...)
+	if config.slack < 0 {
+		panic("gcra slack is not >= 0")
+	}
+	emissionInterval := config.per / time.Duration(rate)
+	return &GCRA{
+		emissionInterval: emissionInterval,
+		tolerance:        emissionInterval * time.Duration(config.slack+1),
+		limit:            int64(config.slack) + 1,
+		clock:            config.clock,
+	}
+}
+
+// Throttle 尝试拿 n 个许可，在一次 CAS 里算出判定结果和剩余额度
+func (g *GCRA) Throttle(n int64) Result {
+	for {
+		now := g.clock.Now().UnixNano()
+		tat := atomic.LoadInt64(&g.tat)
+		res, newTat := g.throttle(now, tat, n)
+		if !res.Allowed || n <= 0 {
+			return res
+		}
+		if atomic.CompareAndSwapInt64(&g.tat, tat, newTat) {
+			return res
+		}
+	}
+}
+
+func (g *GCRA) throttle(now, tat, n int64) (Result, int64) {
+	if tat < now {
+		tat = now
+	}
+	increment := int64(g.emissionInterval) * n
+	newTat := tat + increment
+	allowAt := newTat - int64(g.tolerance)
+
+	res := Result{Limit: g.limit, RetryAfter: -1}
+	var ttl int64
+	if diff := now - allowAt; diff < 0 {
+		// 一次要的比突发量还多时永远无法满足，不给重试时间
+		if increment <= int64(g.tolerance) {
+			res.RetryAfter = time.Duration(-diff)
+		}
+		ttl = tat - now
+	} else {
+		res.Allowed = true
+		ttl = newTat - now
+	}
+	if next := int64(g.tolerance) - ttl; next > -int64(g.emissionInterval) {
+		res.Remaining = next / int64(g.emissionInterval)
+	}
+	res.ResetAfter = time.Duration(ttl)
+	return res, newTat
+}
+
+// Idle TAT 已经过去，额度是满的
+func (g *GCRA) Idle() bool {
+	return atomic.LoadInt64(&g.tat) <= g.clock.Now().UnixNano()
+}
+
+func (g *GCRA) Allow() bool {
+	return g.AllowN(1)
+}
+
+func (g *GCRA) AllowN(n int64) bool {
+	return g.Throttle(n).Allowed
+}
+
+func (g *GCRA) Reserve() *Reservation {
+	return g.ReserveN(1)
+}
+
+func (g *GCRA) ReserveN(n int64) *Reservation {
+	return g.reserveN(n, infinityDuration)
+}
+
+func (g *GCRA) ReserveMaxDuration(n int64, maxWait time.Duration) *Reservation {
+	return g.reserveN(n, maxWait)
+}
+
+func (g *GCRA) Wait() error {
+	return g.WaitN(1)
+}
+
+func (g *GCRA) WaitN(n int64) error {
+	rv := g.ReserveN(n)
+	if !rv.OK() {
+		return ErrExceedsLimit
+	}
+	if d := rv.Delay(); d > 0 {
+		g.clock.Sleep(d)
+	}
+	return nil
+}
+
+func (g *GCRA) WaitContext(ctx context.Context, n int64) error {
+	maxWait, err := waitBudget(ctx, g.clock)
+	if err != nil {
+		return err
+	}
+	return g.reserveN(n, maxWait).Wait(ctx)
+}
+
+// reserveN 不管能不能马上放行都推进 TAT，需要等待的时间就是 allowAt - now
+func (g *GCRA) reserveN(n int64, maxWait time.Duration) *Reservation {
+	r := &Reservation{clock: g.clock}
+	increment := int64(g.emissionInterval) * n
+	for {
+		now := g.clock.Now().UnixNano()
+		if n <= 0 {
+			r.ok = true
+			r.timeToAct = time.Unix(0, now)
+			return r
+		}
+		if increment > int64(g.tolerance) {
+			return r
+		}
+		tat := atomic.LoadInt64(&g.tat)
+		base := tat
+		if base < now {
+			base = now
+		}
+		newTat := base + increment
+		allowAt := newTat - int64(g.tolerance)
+		if allowAt < now {
+			allowAt = now
+		}
+		if time.Duration(allowAt-now) > maxWait {
+			r.timeToAct = time.Unix(0, allowAt)
+			return r
+		}
+		if atomic.CompareAndSwapInt64(&g.tat, tat, newTat) {
+			r.ok = true
+			r.timeToAct = time.Unix(0, allowAt)
+			r.cancel = func() { g.cancel(increment, newTat, allowAt) }
+			return r
+		}
+	}
+}
+
+// cancel 只有 TAT 还是这次预留推进到的 newTat 时才回退，
+// 否则后面的预留已经排在它之后，回退会把同一个时间片再发给别的请求
+func (g *GCRA) cancel(increment, newTat, allowAt int64) {
+	if allowAt <= g.clock.Now().UnixNano() {
+		return
+	}
+	atomic.CompareAndSwapInt64(&g.tat, newTat, newTat-increment)
+}
@@ -0,0 +1,92 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+// same scenario as the redis-cell README: CL.THROTTLE user123 15 30 60 1
+func TestGCRAThrottle(t *testing.T) {
+	clk := clock.NewMock()
+	clk.Set(time.Now())
+	g := NewGCRA(30, WithSlack(15), WithPer(time.Minute), WithClock(clk))
+
+	res := g.Throttle(1)
+	assert.Equal(t, Result{
+		Allowed:    true,
+		Limit:      16,
+		Remaining:  15,
+		RetryAfter: -1,
+		ResetAfter: 2 * time.Second,
+	}, res)
+
+	for i := 0; i < 15; i++ {
+		assert.True(t, g.Throttle(1).Allowed)
+	}
+	res = g.Throttle(1)
+	assert.Equal(t, Result{
+		Allowed:    false,
+		Limit:      16,
+		Remaining:  0,
+		RetryAfter: 2 * time.Second,
+		ResetAfter: 32 * time.Second,
+	}, res)
+
+	clk.Add(2 * time.Second)
+	res = g.Throttle(1)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, int64(0), res.Remaining)
+
+	// more than the burst can never be allowed
+	res = g.Throttle(17)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, time.Duration(-1), res.RetryAfter)
+}
+
+func TestGCRAReserve(t *testing.T) {
+	clk := clock.NewMock()
+	clk.Set(time.Now())
+	g := NewGCRA(10, WithSlack(0), WithClock(clk))
+
+	assert.True(t, g.Allow())
+	r := g.ReserveN(1)
+	assert.True(t, r.OK())
+	assert.Equal(t, 100*time.Millisecond, r.Delay())
+	assert.False(t, g.ReserveN(2).OK())
+
+	r.Cancel()
+	clk.Add(100 * time.Millisecond)
+	assert.True(t, g.Allow())
+	assert.False(t, g.Allow())
+}
+
+func TestGCRAWaitNExceedsLimit(t *testing.T) {
+	clk := clock.NewMock()
+	clk.Set(time.Now())
+	g := NewGCRA(1, WithSlack(0), WithClock(clk))
+	assert.ErrorIs(t, g.WaitN(3), ErrExceedsLimit)
+	assert.NoError(t, g.Wait())
+}
+
+func TestGCRACancelKeepsLaterReservations(t *testing.T) {
+	clk := clock.NewMock()
+	clk.Set(time.Now())
+	g := NewGCRA(10, WithSlack(0), WithClock(clk))
+
+	g.Reserve()
+	b := g.Reserve()
+	c := g.Reserve()
+	assert.Equal(t, 200*time.Millisecond, c.Delay())
+
+	// b 后面还有 c，不能把 b 的时间片再发出去
+	b.Cancel()
+	assert.Equal(t, 300*time.Millisecond, g.Reserve().Delay())
+
+	// 最后一个预留可以还回去
+	e := g.Reserve()
+	e.Cancel()
+	assert.Equal(t, 400*time.Millisecond, g.Reserve().Delay())
+}
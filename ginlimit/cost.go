@@ -0,0 +1,57 @@
+package ginlimit
+
+// 依赖 gin.Context 的请求代价
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wwqdrh/ratelimit"
+)
+
+// CostFunc 从 gin.Context 中计算请求消耗多少个令牌，返回 0 时这次请求不消耗额度
+type CostFunc func(c *gin.Context) (int64, error)
+
+// WithCostFunc 使用 gin.Context 计算请求的代价
+func WithCostFunc(costFunc CostFunc) ratelimit.MiddlewareOption {
+	return ratelimit.MiddlewareWithCost(Cost(costFunc))
+}
+
+// Cost 转成 ratelimit.CostFunc
+func Cost(costFunc CostFunc) ratelimit.CostFunc {
+	return func(r *http.Request) (int64, error) {
+		c := ginContext(r)
+		if c == nil {
+			return 0, fmt.Errorf("ginlimit: request is not from a gin middleware")
+		}
+		return costFunc(c)
+	}
+}
+
+// CostByRoute 按路由模板查表，key 的格式和 KeyByRoute 一样，比如 GET /export/:id，没有匹配时为 def
+func CostByRoute(costs map[string]int64, def int64) CostFunc {
+	return func(c *gin.Context) (int64, error) {
+		if cost, ok := costs[c.Request.Method+" "+c.FullPath()]; ok {
+			return cost, nil
+		}
+		return def, nil
+	}
+}
+
+// CostByContext 前面的中间件通过 c.Set 保存的代价，没有设置时为 def
+func CostByContext(name string, def int64) CostFunc {
+	return func(c *gin.Context) (int64, error) {
+		val, ok := c.Get(name)
+		if !ok {
+			return def, nil
+		}
+		switch cost := val.(type) {
+		case int64:
+			return cost, nil
+		case int:
+			return int64(cost), nil
+		}
+		return 0, fmt.Errorf("ginlimit: cost %q is %T, not an integer", name, val)
+	}
+}
@@ -0,0 +1,107 @@
+// Package ginlimit 把 ratelimit 中 net/http 风格的中间件适配到 gin
+package ginlimit
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wwqdrh/ratelimit"
+)
+
+type ginContextKey struct{}
+
+// Wrap 把 func(http.Handler) http.Handler 形式的中间件转成 gin.HandlerFunc
+// 中间件没有调用下一个 handler 时(被限流或者出错)中止后续的 handler
+func Wrap(mw func(http.Handler) http.Handler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		passed := false
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			passed = true
+			c.Request = r
+			c.Next()
+		})
+		req := c.Request.WithContext(context.WithValue(c.Request.Context(), ginContextKey{}, c))
+		mw(next).ServeHTTP(c.Writer, req)
+		if !passed {
+			c.Abort()
+		}
+	}
+}
+
+// ginContext 取出 Wrap 时保存的 gin.Context
+func ginContext(r *http.Request) *gin.Context {
+	c, _ := r.Context().Value(ginContextKey{}).(*gin.Context)
+	return c
+}
+
+// 令牌桶
+func TokenBucketMiddleware(fillInterval time.Duration, cap, quantum int64, opts ...ratelimit.MiddlewareOption) gin.HandlerFunc {
+	return Wrap(ratelimit.TokenBucketMiddleware(fillInterval, cap, quantum, opts...))
+}
+
+// 漏桶 一秒能过多少请求，qps
+func LeakyBucketMiddleware(rate int, opts ...ratelimit.MiddlewareOption) gin.HandlerFunc {
+	return Wrap(ratelimit.LeakyBucketMiddleware(rate, opts...))
+}
+
+// GCRA 每 per 时间放行 rate 个请求，允许 burst 个突发，拿不到许可直接拒绝
+func GCRAMiddleware(rate, burst int, per time.Duration, opts ...ratelimit.MiddlewareOption) gin.HandlerFunc {
+	return Wrap(ratelimit.GCRAMiddleware(rate, burst, per, opts...))
+}
+
+// 固定窗口 每个窗口内最多通过 limit 个请求
+func FixedWindowMiddleware(limit int64, window time.Duration, opts ...ratelimit.MiddlewareOption) gin.HandlerFunc {
+	return Wrap(ratelimit.FixedWindowMiddleware(limit, window, opts...))
+}
+
+// 滑动窗口计数器 按上一个窗口加权估算，内存占用小
+func SlidingWindowMiddleware(limit int64, window time.Duration, opts ...ratelimit.MiddlewareOption) gin.HandlerFunc {
+	return Wrap(ratelimit.SlidingWindowMiddleware(limit, window, opts...))
+}
+
+// 滑动窗口日志 任意 window 时间内最多通过 limit 个请求
+func SlidingLogMiddleware(limit int64, window time.Duration, opts ...ratelimit.MiddlewareOption) gin.HandlerFunc {
+	return Wrap(ratelimit.SlidingLogMiddleware(limit, window, opts...))
+}
+
+// 并发数 同时最多 limit 个请求在处理，handler 返回或者 panic 时归还许可
+func ConcurrencyMiddleware(limit int64, opts ...ratelimit.MiddlewareOption) gin.HandlerFunc {
+	return Wrap(ratelimit.ConcurrencyMiddleware(limit, opts...))
+}
+
+// 自适应并发数 所有请求共用 limiter，5xx 的响应和 panic 当作丢弃
+func AdaptiveMiddleware(limiter *ratelimit.AdaptiveLimiter, opts ...ratelimit.MiddlewareOption) gin.HandlerFunc {
+	return Wrap(ratelimit.AdaptiveMiddleware(limiter, opts...))
+}
+
+// BBR 过载保护 CPU 使用率过高并且正在处理的请求数超过处理能力时拒绝
+func BBRMiddleware(bbr *ratelimit.BBR, opts ...ratelimit.MiddlewareOption) gin.HandlerFunc {
+	return Wrap(ratelimit.BBRMiddleware(bbr, opts...))
+}
+
+// 分布式限流 比如 redis-cell，访问后端失败时返回 503
+func DistributedMiddleware(limiter ratelimit.DistributedLimiter, opts ...ratelimit.MiddlewareOption) gin.HandlerFunc {
+	return Wrap(ratelimit.DistributedMiddleware(limiter, opts...))
+}
+
+// DenyHandler 请求被限流时怎么响应，响应头已经设置好了
+type DenyHandler func(c *gin.Context, res ratelimit.Result)
+
+// WithDenyHandler 使用 gin.Context 自定义被限流时的响应
+func WithDenyHandler(handler DenyHandler) ratelimit.MiddlewareOption {
+	return ratelimit.MiddlewareWithDenyHandler(func(w http.ResponseWriter, r *http.Request, res ratelimit.Result) {
+		handler(ginContext(r), res)
+	})
+}
+
+// ErrorHandler 访问分布式限流的后端失败时怎么响应
+type ErrorHandler func(c *gin.Context, err error)
+
+// WithErrorHandler 使用 gin.Context 自定义后端失败时的响应，比如 c.Error(err) 之后返回 503
+func WithErrorHandler(handler ErrorHandler) ratelimit.MiddlewareOption {
+	return ratelimit.MiddlewareWithErrorHandler(func(w http.ResponseWriter, r *http.Request, err error) {
+		handler(ginContext(r), err)
+	})
+}
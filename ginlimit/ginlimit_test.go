@@ -0,0 +1,171 @@
+package ginlimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/wwqdrh/ratelimit"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func newTestEngine(mw gin.HandlerFunc) (*gin.Engine, *int) {
+	handled := 0
+	r := gin.New()
+	r.Use(mw)
+	r.GET("/user/:id", func(c *gin.Context) {
+		handled++
+		c.String(http.StatusOK, "ok")
+	})
+	return r, &handled
+}
+
+func doRequest(r http.Handler, path string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestWrap(t *testing.T) {
+	r, handled := newTestEngine(TokenBucketMiddleware(time.Hour, 1, 1))
+
+	w := doRequest(r, "/user/1", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "ok", w.Body.String())
+	assert.Equal(t, "0", w.Header().Get(ratelimit.HeaderXRateLimitRemaining))
+
+	w = doRequest(r, "/user/1", nil)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, 1, *handled)
+}
+
+func TestKeyByRoute(t *testing.T) {
+	r, _ := newTestEngine(TokenBucketMiddleware(time.Hour, 1, 1, WithKeyFunc(KeyByRoute())))
+
+	assert.Equal(t, http.StatusOK, doRequest(r, "/user/1", nil).Code)
+	// same route template, different url
+	assert.Equal(t, http.StatusTooManyRequests, doRequest(r, "/user/2", nil).Code)
+}
+
+func TestKeyByClientIP(t *testing.T) {
+	r, _ := newTestEngine(TokenBucketMiddleware(time.Hour, 1, 1, WithKeyFunc(KeyByClientIP())))
+	assert.NoError(t, r.SetTrustedProxies([]string{"10.0.0.0/8"}))
+
+	forwarded := func(ip string) map[string]string {
+		return map[string]string{"X-Forwarded-For": ip}
+	}
+	assert.Equal(t, http.StatusOK, doRequest(r, "/user/1", forwarded("1.1.1.1")).Code)
+	assert.Equal(t, http.StatusTooManyRequests, doRequest(r, "/user/2", forwarded("1.1.1.1")).Code)
+	assert.Equal(t, http.StatusOK, doRequest(r, "/user/1", forwarded("2.2.2.2")).Code)
+
+	// 取不到客户端的地址时交给 ErrorHandler，不能跳过限流
+	req := httptest.NewRequest(http.MethodGet, "/user/1", nil)
+	req.RemoteAddr = ""
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func TestKeyByContext(t *testing.T) {
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("user", c.GetHeader("X-User"))
+	})
+	r.Use(TokenBucketMiddleware(time.Hour, 1, 1, WithKeyFunc(KeyByContext("user"))))
+	r.GET("/", func(c *gin.Context) {})
+
+	alice := map[string]string{"X-User": "alice"}
+	assert.Equal(t, http.StatusOK, doRequest(r, "/", alice).Code)
+	assert.Equal(t, http.StatusTooManyRequests, doRequest(r, "/", alice).Code)
+	assert.Equal(t, http.StatusOK, doRequest(r, "/", map[string]string{"X-User": "bob"}).Code)
+	// anonymous requests are not limited
+	assert.Equal(t, http.StatusOK, doRequest(r, "/", nil).Code)
+	assert.Equal(t, http.StatusOK, doRequest(r, "/", nil).Code)
+}
+
+func TestWithDenyHandler(t *testing.T) {
+	r, _ := newTestEngine(FixedWindowMiddleware(1, time.Hour, WithDenyHandler(func(c *gin.Context, res ratelimit.Result) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"remaining": res.Remaining})
+	})))
+
+	assert.Equal(t, http.StatusOK, doRequest(r, "/user/1", nil).Code)
+	w := doRequest(r, "/user/1", nil)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.JSONEq(t, `{"remaining":0}`, w.Body.String())
+}
+
+// downLimiter 后端一直不可用
+type downLimiter struct{}
+
+func (downLimiter) Throttle(ctx context.Context, key string, n int64) (ratelimit.Result, error) {
+	return ratelimit.Result{}, errors.New("backend is down")
+}
+
+func TestWithErrorHandler(t *testing.T) {
+	r, handled := newTestEngine(DistributedMiddleware(downLimiter{}, WithErrorHandler(func(c *gin.Context, err error) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "unavailable"})
+	})))
+
+	w := doRequest(r, "/user/1", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.JSONEq(t, `{"error":"unavailable"}`, w.Body.String())
+	assert.Equal(t, 0, *handled)
+}
+
+func TestWithCostFunc(t *testing.T) {
+	r := gin.New()
+	r.Use(TokenBucketMiddleware(time.Hour, 10, 1,
+		WithKeyFunc(KeyByClientIP()), WithCostFunc(CostByRoute(map[string]int64{"GET /export/:id": 6}, 1))))
+	r.GET("/export/:id", func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+	r.GET("/user/:id", func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+
+	assert.Equal(t, http.StatusOK, doRequest(r, "/export/1", nil).Code)
+	w := doRequest(r, "/user/1", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "3", w.Header().Get(ratelimit.HeaderXRateLimitRemaining))
+	assert.Equal(t, http.StatusTooManyRequests, doRequest(r, "/export/2", nil).Code)
+}
+
+func TestReportCost(t *testing.T) {
+	r := gin.New()
+	r.Use(TokenBucketMiddleware(time.Hour, 10, 1,
+		WithKeyFunc(KeyByClientIP()), ratelimit.MiddlewareWithActualCost(ratelimit.ChargeByReport())))
+	r.GET("/rows/:n", func(c *gin.Context) {
+		n, _ := strconv.Atoi(c.Param("n"))
+		ratelimit.ReportCost(c.Request.Context(), int64(n))
+		c.String(http.StatusOK, "ok")
+	})
+
+	assert.Equal(t, http.StatusOK, doRequest(r, "/rows/8", nil).Code)
+	w := doRequest(r, "/rows/1", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "1", w.Header().Get(ratelimit.HeaderXRateLimitRemaining))
+	assert.Equal(t, http.StatusOK, doRequest(r, "/rows/1", nil).Code)
+	assert.Equal(t, http.StatusTooManyRequests, doRequest(r, "/rows/1", nil).Code)
+}
+
+func TestConcurrencyMiddlewarePanic(t *testing.T) {
+	r := gin.New()
+	r.Use(gin.CustomRecovery(func(c *gin.Context, err interface{}) {
+		c.AbortWithStatus(http.StatusInternalServerError)
+	}))
+	r.Use(ConcurrencyMiddleware(1, ratelimit.MiddlewareWithMaxWait(0), WithKeyFunc(KeyByRoute())))
+	r.GET("/panic", func(c *gin.Context) { panic("boom") })
+
+	assert.Equal(t, http.StatusInternalServerError, doRequest(r, "/panic", nil).Code)
+	assert.Equal(t, http.StatusInternalServerError, doRequest(r, "/panic", nil).Code)
+}
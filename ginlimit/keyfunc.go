@@ -0,0 +1,62 @@
+package ginlimit
+
+// 依赖 gin.Context 的限流 key
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wwqdrh/ratelimit"
+)
+
+// KeyFunc 从 gin.Context 中取出限流的 key，返回空字符串时这次请求不限流
+type KeyFunc func(c *gin.Context) (string, error)
+
+// WithKeyFunc 使用 gin.Context 提取限流的 key
+func WithKeyFunc(keyFunc KeyFunc) ratelimit.MiddlewareOption {
+	return ratelimit.MiddlewareWithKeyFunc(Key(keyFunc))
+}
+
+// Key 转成 ratelimit.KeyFunc，可以和 ratelimit.KeyComposite 一起使用
+func Key(keyFunc KeyFunc) ratelimit.KeyFunc {
+	return func(r *http.Request) (string, error) {
+		c := ginContext(r)
+		if c == nil {
+			return "", fmt.Errorf("ginlimit: request is not from a gin middleware")
+		}
+		return keyFunc(c)
+	}
+}
+
+// KeyByClientIP 客户端 IP，是否信任代理转发的地址由 gin.Engine.SetTrustedProxies 决定，
+// 取不到 IP 时返回错误
+func KeyByClientIP() KeyFunc {
+	return func(c *gin.Context) (string, error) {
+		if ip := c.ClientIP(); ip != "" {
+			return ip, nil
+		}
+		return "", fmt.Errorf("ginlimit: invalid remote address %q", c.Request.RemoteAddr)
+	}
+}
+
+// KeyByRoute 路由模板，比如 GET /user/:id，没有匹配到路由时为空
+func KeyByRoute() KeyFunc {
+	return func(c *gin.Context) (string, error) {
+		if path := c.FullPath(); path != "" {
+			return c.Request.Method + " " + path, nil
+		}
+		return "", nil
+	}
+}
+
+// KeyByContext 前面的中间件通过 c.Set 保存的值，比如认证之后的用户 ID
+func KeyByContext(name string) KeyFunc {
+	return func(c *gin.Context) (string, error) {
+		val, ok := c.Get(name)
+		if !ok || val == nil {
+			return "", nil
+		}
+		return fmt.Sprint(val), nil
+	}
+}
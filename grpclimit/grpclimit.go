@@ -0,0 +1,112 @@
+// Package grpclimit 把 ratelimit 中的限流器用在 grpc 服务端
+//
+// 被限流的调用返回 codes.ResourceExhausted，知道重试时间时在 status details 中附带 errdetails.RetryInfo
+package grpclimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/wwqdrh/ratelimit"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+type config struct {
+	keyFunc KeyFunc
+	maxWait time.Duration // 0 表示不排队
+}
+
+type Option func(c *config)
+
+// WithKeyFunc 按什么维度限流，默认为完整的方法名
+func WithKeyFunc(keyFunc KeyFunc) Option {
+	return func(c *config) {
+		c.keyFunc = keyFunc
+	}
+}
+
+// WithMaxWait 拿不到许可时最多排队多久，同时不会超过调用的截止时间，默认不排队直接拒绝
+func WithMaxWait(maxWait time.Duration) Option {
+	return func(c *config) {
+		c.maxWait = maxWait
+	}
+}
+
+func newConfig(opts ...Option) config {
+	c := config{
+		keyFunc: KeyByMethod(),
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// UnaryServerInterceptor getLimiter 按 key 取出限流器，比如 ratelimit.TokenBuckets(...)
+func UnaryServerInterceptor(getLimiter func(key string) ratelimit.Limiter, opts ...Option) grpc.UnaryServerInterceptor {
+	conf := newConfig(opts...)
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := conf.limit(ctx, info.FullMethod, getLimiter); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor 每次建立流时拿一个许可，流中的消息不再限流
+func StreamServerInterceptor(getLimiter func(key string) ratelimit.Limiter, opts ...Option) grpc.StreamServerInterceptor {
+	conf := newConfig(opts...)
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := conf.limit(ss.Context(), info.FullMethod, getLimiter); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+func (c *config) limit(ctx context.Context, fullMethod string, getLimiter func(key string) ratelimit.Limiter) error {
+	key, err := c.keyFunc(ctx, fullMethod)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if key == "" {
+		return nil
+	}
+	limiter := getLimiter(key)
+	if c.maxWait <= 0 {
+		if res := ratelimit.Throttle(limiter, 1); !res.Allowed {
+			return exhausted(res.RetryAfter)
+		}
+		return nil
+	}
+
+	maxWait := c.maxWait
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < maxWait {
+		maxWait = time.Until(deadline)
+	}
+	// 需要等待的时间超过 maxWait 时不预留，等排在前面的调用少一些再来
+	rv := limiter.ReserveMaxDuration(1, maxWait)
+	if !rv.OK() {
+		return exhausted(rv.Delay() - maxWait)
+	}
+	if err := rv.Wait(ctx); err != nil {
+		return status.FromContextError(err).Err()
+	}
+	return nil
+}
+
+// exhausted retryAfter <= 0 时不附带 RetryInfo
+func exhausted(retryAfter time.Duration) error {
+	st := status.New(codes.ResourceExhausted, "rate limit...")
+	if retryAfter <= 0 {
+		return st.Err()
+	}
+	if detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(retryAfter)}); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
@@ -0,0 +1,142 @@
+package grpclimit
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wwqdrh/ratelimit"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestClient 启动一个内存中的 health 服务
+func newTestClient(t *testing.T, opts ...grpc.ServerOption) healthpb.HealthClient {
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(opts...)
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return healthpb.NewHealthClient(conn)
+}
+
+func check(client healthpb.HealthClient, md ...string) error {
+	ctx := metadata.AppendToOutgoingContext(context.Background(), md...)
+	_, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+	return err
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	client := newTestClient(t, grpc.UnaryInterceptor(
+		UnaryServerInterceptor(ratelimit.TokenBuckets(time.Hour, 2, 1, nil)),
+	))
+
+	assert.NoError(t, check(client))
+	assert.NoError(t, check(client))
+
+	err := check(client)
+	st := status.Convert(err)
+	assert.Equal(t, codes.ResourceExhausted, st.Code())
+	require.Len(t, st.Details(), 1)
+	info, ok := st.Details()[0].(*errdetails.RetryInfo)
+	require.True(t, ok)
+	assert.InDelta(t, time.Hour, info.RetryDelay.AsDuration(), float64(time.Second))
+}
+
+func TestKeyByMetadata(t *testing.T) {
+	client := newTestClient(t, grpc.UnaryInterceptor(
+		UnaryServerInterceptor(ratelimit.TokenBuckets(time.Hour, 1, 1, nil), WithKeyFunc(KeyByMetadata("x-api-key"))),
+	))
+
+	assert.NoError(t, check(client, "x-api-key", "a"))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(check(client, "x-api-key", "a")))
+	assert.NoError(t, check(client, "x-api-key", "b"))
+	// 没有 key 的调用不限流
+	assert.NoError(t, check(client))
+	assert.NoError(t, check(client))
+}
+
+func TestKeyByPeer(t *testing.T) {
+	client := newTestClient(t, grpc.UnaryInterceptor(
+		UnaryServerInterceptor(ratelimit.TokenBuckets(time.Hour, 1, 1, nil), WithKeyFunc(KeyComposite(KeyByPeer(), KeyByMethod()))),
+	))
+
+	assert.NoError(t, check(client))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(check(client)))
+}
+
+func TestMaxWait(t *testing.T) {
+	client := newTestClient(t, grpc.UnaryInterceptor(
+		UnaryServerInterceptor(ratelimit.LeakyBuckets(10, nil), WithMaxWait(250*time.Millisecond)),
+	))
+
+	// 每 100ms 放行一个，最多排队 250ms，同时到达的调用只有前 3 个能通过
+	errs := make(chan error, 6)
+	for i := 0; i < cap(errs); i++ {
+		go func() { errs <- check(client) }()
+	}
+	passed := 0
+	for i := 0; i < cap(errs); i++ {
+		err := <-errs
+		if err == nil {
+			passed++
+			continue
+		}
+		assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	}
+	assert.GreaterOrEqual(t, passed, 3)
+	assert.Less(t, passed, cap(errs))
+}
+
+func TestMaxWaitDeadline(t *testing.T) {
+	client := newTestClient(t, grpc.UnaryInterceptor(
+		UnaryServerInterceptor(ratelimit.LeakyBuckets(1, nil), WithMaxWait(time.Hour)),
+	))
+	assert.NoError(t, check(client))
+
+	// 需要等一秒，超过了调用的截止时间
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Less(t, time.Since(start), 50*time.Millisecond)
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	client := newTestClient(t, grpc.StreamInterceptor(
+		StreamServerInterceptor(ratelimit.TokenBuckets(time.Hour, 1, 1, nil)),
+	))
+
+	watch := func() error {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+		if err != nil {
+			return err
+		}
+		_, err = stream.Recv()
+		return err
+	}
+	assert.NoError(t, watch())
+	assert.Equal(t, codes.ResourceExhausted, status.Code(watch()))
+}
@@ -0,0 +1,65 @@
+package grpclimit
+
+// 限流 key 的提取方式
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// KeyFunc 从调用中取出限流的 key，返回空字符串时这次调用不限流
+type KeyFunc func(ctx context.Context, fullMethod string) (string, error)
+
+// KeyByMethod 完整的方法名，比如 /helloworld.Greeter/SayHello
+func KeyByMethod() KeyFunc {
+	return func(ctx context.Context, fullMethod string) (string, error) {
+		return fullMethod, nil
+	}
+}
+
+// KeyByPeer 对端地址，不包括端口
+func KeyByPeer() KeyFunc {
+	return func(ctx context.Context, fullMethod string) (string, error) {
+		p, ok := peer.FromContext(ctx)
+		if !ok || p.Addr == nil {
+			return "", nil
+		}
+		addr := p.Addr.String()
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			return host, nil
+		}
+		return addr, nil
+	}
+}
+
+// KeyByMetadata 请求元数据中 name 对应的第一个值，比如 x-api-key
+func KeyByMetadata(name string) KeyFunc {
+	return func(ctx context.Context, fullMethod string) (string, error) {
+		if vals := metadata.ValueFromIncomingContext(ctx, name); len(vals) > 0 {
+			return vals[0], nil
+		}
+		return "", nil
+	}
+}
+
+// KeyComposite 组合多个 key，任意一个为空时整个 key 为空
+func KeyComposite(fns ...KeyFunc) KeyFunc {
+	return func(ctx context.Context, fullMethod string) (string, error) {
+		parts := make([]string, 0, len(fns))
+		for _, fn := range fns {
+			part, err := fn(ctx, fullMethod)
+			if err != nil {
+				return "", err
+			}
+			if part == "" {
+				return "", nil
+			}
+			parts = append(parts, part)
+		}
+		return strings.Join(parts, "|"), nil
+	}
+}
@@ -0,0 +1,78 @@
+package ratelimit
+
+// 限流相关的响应头
+//
+// X-RateLimit-* 是大多数 API 使用的事实标准，RateLimit-Policy/RateLimit 来自
+// https://datatracker.ietf.org/doc/draft-ietf-httpapi-ratelimit-headers/
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	HeaderRetryAfter          = "Retry-After"
+	HeaderXRateLimitLimit     = "X-RateLimit-Limit"
+	HeaderXRateLimitRemaining = "X-RateLimit-Remaining"
+	HeaderXRateLimitReset     = "X-RateLimit-Reset"
+	HeaderRateLimitPolicy     = "RateLimit-Policy"
+	HeaderRateLimit           = "RateLimit"
+)
+
+// DenyHandler 请求被限流时怎么响应，响应头已经设置好了
+type DenyHandler func(w http.ResponseWriter, r *http.Request, res Result)
+
+// DefaultDenyHandler 返回 429 Too Many Requests
+func DefaultDenyHandler(w http.ResponseWriter, r *http.Request, res Result) {
+	http.Error(w, "rate limit...", http.StatusTooManyRequests)
+}
+
+// ErrorHandler 访问分布式限流的后端失败，或者取不到限流的 key、算不出代价时怎么响应，可以在这里记录 err
+type ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+
+// DefaultErrorHandler 返回 503 Service Unavailable，不把错误信息暴露给客户端
+func DefaultErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+}
+
+// Throttle 拿 n 个许可，限流器没有实现 Throttler 时只能给出是否放行
+func Throttle(l Limiter, n int64) Result {
+	if t, ok := l.(Throttler); ok {
+		return t.Throttle(n)
+	}
+	return Result{Allowed: l.AllowN(n), RetryAfter: -1}
+}
+
+// setRateLimitHeaders Limit 未知时只设置 Retry-After 和 RateLimit-Policy
+func setRateLimitHeaders(h http.Header, policy string, res Result) {
+	if !res.Allowed && res.RetryAfter > 0 {
+		h.Set(HeaderRetryAfter, strconv.FormatInt(ceilSeconds(res.RetryAfter), 10))
+	}
+	if policy != "" {
+		h.Set(HeaderRateLimitPolicy, policy)
+	}
+	if res.Limit <= 0 {
+		return
+	}
+	limit := strconv.FormatInt(res.Limit, 10)
+	remaining := strconv.FormatInt(res.Remaining, 10)
+	reset := strconv.FormatInt(ceilSeconds(res.ResetAfter), 10)
+	h.Set(HeaderXRateLimitLimit, limit)
+	h.Set(HeaderXRateLimitRemaining, remaining)
+	h.Set(HeaderXRateLimitReset, reset)
+	h.Set(HeaderRateLimit, fmt.Sprintf("limit=%s, remaining=%s, reset=%s", limit, remaining, reset))
+}
+
+// quotaPolicy window 时间内允许 limit 个请求，比如 "100;w=60"
+func quotaPolicy(limit int64, window time.Duration) string {
+	return fmt.Sprintf("%d;w=%d", limit, ceilSeconds(window))
+}
+
+func ceilSeconds(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64((d + time.Second - 1) / time.Second)
+}
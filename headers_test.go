@@ -0,0 +1,47 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimitHeaders(t *testing.T) {
+	r := newTestHandler(TokenBucketMiddleware(time.Second, 2, 1))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/user/1", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2", w.Header().Get(HeaderXRateLimitLimit))
+	assert.Equal(t, "1", w.Header().Get(HeaderXRateLimitRemaining))
+	assert.Equal(t, "1", w.Header().Get(HeaderXRateLimitReset))
+	assert.Equal(t, "2;w=2", w.Header().Get(HeaderRateLimitPolicy))
+	assert.Equal(t, "limit=2, remaining=1, reset=1", w.Header().Get(HeaderRateLimit))
+	assert.Empty(t, w.Header().Get(HeaderRetryAfter))
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/user/1", nil))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/user/1", nil))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "0", w.Header().Get(HeaderXRateLimitRemaining))
+	assert.Equal(t, "1", w.Header().Get(HeaderRetryAfter))
+}
+
+func TestDenyHandler(t *testing.T) {
+	r := newTestHandler(FixedWindowMiddleware(1, time.Hour, MiddlewareWithDenyHandler(func(w http.ResponseWriter, r *http.Request, res Result) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = fmt.Fprintf(w, `{"retry_after":%d}`, ceilSeconds(res.RetryAfter))
+	})))
+
+	assert.Equal(t, http.StatusOK, doRequest(r, "/user/1", nil))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/user/1", nil))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, w.Header().Get(HeaderRetryAfter), w.Header().Get(HeaderXRateLimitReset))
+	assert.JSONEq(t, `{"retry_after":`+w.Header().Get(HeaderRetryAfter)+`}`, w.Body.String())
+}
@@ -0,0 +1,132 @@
+package ratelimit
+
+// 限流 key 的提取方式
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// KeyFunc 从请求中取出限流的 key，返回空字符串时这次请求不限流
+type KeyFunc func(r *http.Request) (string, error)
+
+// KeyByURL 完整的请求地址，包括查询参数
+func KeyByURL() KeyFunc {
+	return func(r *http.Request) (string, error) {
+		return fmt.Sprint(r.URL), nil
+	}
+}
+
+// KeyByHost 请求的目标 host，客户端限流时使用
+func KeyByHost() KeyFunc {
+	return func(r *http.Request) (string, error) {
+		if r.URL != nil && r.URL.Host != "" {
+			return r.URL.Host, nil
+		}
+		return r.Host, nil
+	}
+}
+
+// KeyByClientIP 客户端 IP
+// 只有直接连过来的地址属于 trustedProxies(IP 或者 CIDR)时才会去看 X-Forwarded-For 和 X-Real-Ip，
+// 从右往左跳过可信的代理，取第一个不可信的地址。RemoteAddr 不是合法的 IP 时返回错误
+func KeyByClientIP(trustedProxies ...string) KeyFunc {
+	trusted := make([]*net.IPNet, 0, len(trustedProxies))
+	for _, proxy := range trustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, cidr, err := net.ParseCIDR(proxy)
+		if err != nil {
+			panic(fmt.Sprintf("ratelimit: invalid trusted proxy %q", proxy))
+		}
+		trusted = append(trusted, cidr)
+	}
+	isTrusted := func(ip net.IP) bool {
+		for _, cidr := range trusted {
+			if cidr.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(r *http.Request) (string, error) {
+		remote, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
+		if err != nil {
+			remote = strings.TrimSpace(r.RemoteAddr)
+		}
+		remoteIP := net.ParseIP(remote)
+		if remoteIP == nil {
+			// 返回空字符串的话这个请求就不限流了
+			return "", fmt.Errorf("ratelimit: invalid remote address %q", r.RemoteAddr)
+		}
+		if !isTrusted(remoteIP) {
+			return remoteIP.String(), nil
+		}
+
+		addrs := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		for i := len(addrs) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(addrs[i]))
+			if ip == nil {
+				break
+			}
+			if !isTrusted(ip) {
+				return ip.String(), nil
+			}
+		}
+		if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-Ip"))); ip != nil {
+			return ip.String(), nil
+		}
+		return remoteIP.String(), nil
+	}
+}
+
+// KeyByHeader 请求头，比如 X-API-Key
+func KeyByHeader(name string) KeyFunc {
+	return func(r *http.Request) (string, error) {
+		return r.Header.Get(name), nil
+	}
+}
+
+// KeyByQuery 查询参数
+func KeyByQuery(name string) KeyFunc {
+	return func(r *http.Request) (string, error) {
+		return r.URL.Query().Get(name), nil
+	}
+}
+
+// KeyByContext 前面的中间件通过 context.WithValue 保存的值，比如认证之后的用户 ID
+func KeyByContext(key interface{}) KeyFunc {
+	return func(r *http.Request) (string, error) {
+		val := r.Context().Value(key)
+		if val == nil {
+			return "", nil
+		}
+		return fmt.Sprint(val), nil
+	}
+}
+
+// KeyComposite 组合多个 key，任意一个为空时整个 key 为空
+func KeyComposite(fns ...KeyFunc) KeyFunc {
+	return func(r *http.Request) (string, error) {
+		parts := make([]string, 0, len(fns))
+		for _, fn := range fns {
+			part, err := fn(r)
+			if err != nil {
+				return "", err
+			}
+			if part == "" {
+				return "", nil
+			}
+			parts = append(parts, part)
+		}
+		return strings.Join(parts, "|"), nil
+	}
+}
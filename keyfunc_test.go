@@ -0,0 +1,125 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestHandler(mw func(http.Handler) http.Handler) http.Handler {
+	return mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+}
+
+func doRequest(h http.Handler, path string, header map[string]string) int {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w.Code
+}
+
+type userKey struct{}
+
+func TestKeyFuncs(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/user/1?token=abc", nil)
+	r.Header.Set("X-API-Key", "key1")
+	r = r.WithContext(context.WithValue(r.Context(), userKey{}, 42))
+
+	for _, tt := range []struct {
+		about string
+		fn    KeyFunc
+		want  string
+	}{
+		{"url", KeyByURL(), "/user/1?token=abc"},
+		{"header", KeyByHeader("X-API-Key"), "key1"},
+		{"query", KeyByQuery("token"), "abc"},
+		{"context", KeyByContext(userKey{}), "42"},
+		{"missing context", KeyByContext("nobody"), ""},
+		{"composite", KeyComposite(KeyByHeader("X-API-Key"), KeyByQuery("token")), "key1|abc"},
+		{"composite with empty part", KeyComposite(KeyByHeader("X-API-Key"), KeyByQuery("none")), ""},
+	} {
+		key, err := tt.fn(r)
+		assert.NoError(t, err, tt.about)
+		assert.Equal(t, tt.want, key, tt.about)
+	}
+}
+
+func TestKeyByClientIP(t *testing.T) {
+	request := func(remote, forwarded, realIP string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remote
+		if forwarded != "" {
+			r.Header.Set("X-Forwarded-For", forwarded)
+		}
+		if realIP != "" {
+			r.Header.Set("X-Real-Ip", realIP)
+		}
+		return r
+	}
+
+	for _, tt := range []struct {
+		about   string
+		trusted []string
+		req     *http.Request
+		want    string
+	}{
+		{"no proxy", nil, request("1.1.1.1:80", "", ""), "1.1.1.1"},
+		{"untrusted proxy", nil, request("10.0.0.1:80", "1.1.1.1", ""), "10.0.0.1"},
+		{"trusted proxy", []string{"10.0.0.0/8"}, request("10.0.0.1:80", "1.1.1.1", ""), "1.1.1.1"},
+		{"proxy chain", []string{"10.0.0.0/8"}, request("10.0.0.1:80", "2.2.2.2, 1.1.1.1, 10.0.0.2", ""), "1.1.1.1"},
+		{"real ip", []string{"10.0.0.1"}, request("10.0.0.1:80", "", "1.1.1.1"), "1.1.1.1"},
+		{"all trusted", []string{"10.0.0.0/8"}, request("10.0.0.1:80", "10.0.0.2", ""), "10.0.0.1"},
+	} {
+		key, err := KeyByClientIP(tt.trusted...)(tt.req)
+		assert.NoError(t, err, tt.about)
+		assert.Equal(t, tt.want, key, tt.about)
+	}
+
+	// 取不到客户端的地址时不能跳过限流
+	for _, remote := range []string{"", "not an ip:80", "@"} {
+		key, err := KeyByClientIP()(request(remote, "", ""))
+		assert.Error(t, err, remote)
+		assert.Empty(t, key, remote)
+	}
+
+	assert.Panics(t, func() { KeyByClientIP("not an ip") })
+}
+
+func TestMiddlewareSkipEmptyKey(t *testing.T) {
+	h := newTestHandler(TokenBucketMiddleware(time.Hour, 1, 1, MiddlewareWithKeyFunc(KeyByHeader("X-API-Key"))))
+
+	key := map[string]string{"X-API-Key": "key1"}
+	assert.Equal(t, http.StatusOK, doRequest(h, "/user/1", key))
+	assert.Equal(t, http.StatusTooManyRequests, doRequest(h, "/user/1", key))
+	assert.Equal(t, http.StatusOK, doRequest(h, "/user/1", nil))
+	assert.Equal(t, http.StatusOK, doRequest(h, "/user/1", nil))
+}
+
+func TestMiddlewareKeyFuncError(t *testing.T) {
+	keyFunc := MiddlewareWithKeyFunc(func(r *http.Request) (string, error) {
+		return "", errors.New("no key")
+	})
+	h := newTestHandler(TokenBucketMiddleware(time.Hour, 1, 1, keyFunc))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/user/1", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.NotContains(t, w.Body.String(), "no key")
+
+	var got error
+	h = newTestHandler(TokenBucketMiddleware(time.Hour, 1, 1, keyFunc, MiddlewareWithErrorHandler(func(w http.ResponseWriter, r *http.Request, err error) {
+		got = err
+		w.WriteHeader(http.StatusBadRequest)
+	})))
+	assert.Equal(t, http.StatusBadRequest, doRequest(h, "/user/1", nil))
+	assert.EqualError(t, got, "no key")
+}
@@ -3,7 +3,7 @@ package ratelimit
 // 漏桶实现
 
 import (
-	"sync"
+	"context"
 	"sync/atomic"
 	"time"
 
@@ -11,18 +11,22 @@ import (
 )
 
 type leakLimiter interface {
+	Limiter
 	Take() time.Time
+	TakeN(n int64) time.Time
 }
 
 type leakyBucket struct {
-	rate int
+	rate  int
+	clock Clock // 为 nil 时使用真实的时间
 
-	data sync.Map
+	data Store
 }
 
 func (m *leakyBucket) GetBucket(key string) leakLimiter {
-	val, _ := m.data.LoadOrStore(key, NewAtomicInt64Based(m.rate))
-	return val.(leakLimiter)
+	return m.data.LoadOrStore(key, func() interface{} {
+		return NewAtomicInt64Based(m.rate, WithClock(m.clock))
+	}).(leakLimiter)
 }
 
 type config struct {
@@ -77,8 +81,10 @@ type atomicInt64Limiter struct {
 	//lint:ignore U1000 like prepadding.
 	postpadding [56]byte //nolint:structcheck
 
-	perRequest time.Duration
+	perRequest time.Duration // SetRate 会修改，需要通过 limits 读取
 	maxSlack   time.Duration
+	per        time.Duration
+	slack      int
 	clock      Clock
 }
 
@@ -88,38 +94,195 @@ func NewAtomicInt64Based(rate int, opts ...leakOption) *atomicInt64Limiter {
 	l := &atomicInt64Limiter{
 		perRequest: perRequest,
 		maxSlack:   time.Duration(config.slack) * perRequest,
+		per:        config.per,
+		slack:      config.slack,
 		clock:      config.clock,
 	}
 	atomic.StoreInt64(&l.state, 0)
 	return l
 }
 
+// SetRate 调整每 per 时间放行的请求数，已经排好的发放时间不变，从下一个请求开始按新的间隔发放
+func (t *atomicInt64Limiter) SetRate(rate int) {
+	if rate <= 0 {
+		panic("leaky bucket rate is not > 0")
+	}
+	perRequest := t.per / time.Duration(rate)
+	atomic.StoreInt64((*int64)(&t.perRequest), int64(perRequest))
+	atomic.StoreInt64((*int64)(&t.maxSlack), int64(time.Duration(t.slack)*perRequest))
+}
+
+// limits 当前的发放间隔以及允许积累的突发量
+func (t *atomicInt64Limiter) limits() (perRequest, maxSlack int64) {
+	return atomic.LoadInt64((*int64)(&t.perRequest)), atomic.LoadInt64((*int64)(&t.maxSlack))
+}
+
 func (t *atomicInt64Limiter) Take() time.Time {
-	var (
-		newTimeOfNextPermissionIssue int64
-		now                          int64
-	)
+	return t.TakeN(1)
+}
+
+// TakeN 一次拿 n 个许可，阻塞到最后一个许可的发放时间，状态前进 n*perRequest
+func (t *atomicInt64Limiter) TakeN(n int64) time.Time {
+	now, issue, _ := t.reserveN(n, infinityDuration)
+	t.clock.Sleep(time.Duration(issue - now))
+	return time.Unix(0, issue)
+}
+
+// Idle 距离上次发放许可的时间已经超过了允许积累的突发量，
+// 这时重新创建的限流器只会更严格，可以放心丢弃
+func (t *atomicInt64Limiter) Idle() bool {
+	state := atomic.LoadInt64(&t.state)
+	if state == 0 {
+		return true
+	}
+	perRequest, idle := t.limits()
+	if idle < perRequest {
+		idle = perRequest
+	}
+	return t.clock.Now().UnixNano()-state > idle
+}
+
+func (t *atomicInt64Limiter) Allow() bool {
+	return t.AllowN(1)
+}
+
+func (t *atomicInt64Limiter) AllowN(n int64) bool {
+	_, _, ok := t.reserveN(n, 0)
+	return ok
+}
+
+func (t *atomicInt64Limiter) Reserve() *Reservation {
+	return t.ReserveN(1)
+}
+
+func (t *atomicInt64Limiter) ReserveN(n int64) *Reservation {
+	return t.reservation(n, infinityDuration)
+}
+
+func (t *atomicInt64Limiter) ReserveMaxDuration(n int64, maxWait time.Duration) *Reservation {
+	return t.reservation(n, maxWait)
+}
+
+func (t *atomicInt64Limiter) reservation(n int64, maxWait time.Duration) *Reservation {
+	_, issue, ok := t.reserveN(n, maxWait)
+	r := &Reservation{
+		ok:        ok,
+		clock:     t.clock,
+		timeToAct: time.Unix(0, issue),
+	}
+	if ok && n > 0 {
+		r.cancel = func() { t.cancel(n, issue) }
+	}
+	return r
+}
+
+func (t *atomicInt64Limiter) Wait() error {
+	return t.WaitN(1)
+}
+
+// WaitN 许可是一个接一个发放的，n 再大也只是等得久一些，不会返回错误
+func (t *atomicInt64Limiter) WaitN(n int64) error {
+	now, issue, _ := t.reserveN(n, infinityDuration)
+	t.clock.Sleep(time.Duration(issue - now))
+	return nil
+}
+
+// cancel 归还还没到发放时间的许可，last 为预留的最后一个许可的发放时间
+// 只有这次预留仍然是最后一个时才能回退，否则后面的预留已经排在这些时间片之后，
+// 回退会把同一个时间片再发给别的请求
+func (t *atomicInt64Limiter) cancel(n, last int64) {
+	now := t.clock.Now().UnixNano()
+	if last <= now {
+		return
+	}
+	// 许可是一个接一个发放的，已经过去的那部分不能再还
+	perRequest, _ := t.limits()
+	restore := (last - now + perRequest - 1) / perRequest // ceil
+	if restore > n {
+		restore = n
+	}
+	atomic.CompareAndSwapInt64(&t.state, last, last-restore*perRequest)
+}
+
+// Charge 额外占用 n 个时间片，之后的请求要多等 n 个间隔
+func (t *atomicInt64Limiter) Charge(n int64) {
+	if n > 0 {
+		t.reserveN(n, infinityDuration)
+	}
+}
+
+// Refund 还回 n 个时间片，最多还到允许积累的突发量
+// 有请求在排队时不还，排在后面的请求已经占用了之后的时间片，再还回来会重复发放
+func (t *atomicInt64Limiter) Refund(n int64) {
+	if n <= 0 {
+		return
+	}
+	for {
+		now := t.clock.Now().UnixNano()
+		state := atomic.LoadInt64(&t.state)
+		if state == 0 || state > now {
+			return
+		}
+		perRequest, maxSlack := t.limits()
+		floor := now - maxSlack
+		if maxSlack == 0 {
+			floor = now - perRequest
+		}
+		next := state - n*perRequest
+		if next < floor {
+			next = floor
+		}
+		if next >= state {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&t.state, state, next) {
+			return
+		}
+	}
+}
+
+// WaitContext 等待直到拿到 n 个许可
+// ctx 被取消或者截止时间不够等待时提前返回错误，并把占用的时间片还回去
+func (t *atomicInt64Limiter) WaitContext(ctx context.Context, n int64) error {
+	maxWait, err := waitBudget(ctx, t.clock)
+	if err != nil {
+		return err
+	}
+	return t.reservation(n, maxWait).Wait(ctx)
+}
+
+// reserveN 预留 n 个连续的许可，返回当前时间以及最后一个许可的发放时间(unix nanoseconds)
+// 需要等待的时间超过 maxWait 时不修改状态，ok 返回 false
+func (t *atomicInt64Limiter) reserveN(n int64, maxWait time.Duration) (now, issue int64, ok bool) {
+	if n <= 0 {
+		now = t.clock.Now().UnixNano()
+		return now, now, true
+	}
 	for {
 		now = t.clock.Now().UnixNano()
 		timeOfNextPermissionIssue := atomic.LoadInt64(&t.state)
+		perRequest, maxSlack := t.limits()
 
 		switch {
-		case timeOfNextPermissionIssue == 0 || (t.maxSlack == 0 && now-timeOfNextPermissionIssue > int64(t.perRequest)):
+		case timeOfNextPermissionIssue == 0 || (maxSlack == 0 && now-timeOfNextPermissionIssue > perRequest):
 			// if this is our first call or t.maxSlack == 0 we need to shrink issue time to now
-			newTimeOfNextPermissionIssue = now
-		case t.maxSlack > 0 && now-timeOfNextPermissionIssue > int64(t.maxSlack):
+			issue = now
+		case maxSlack > 0 && now-timeOfNextPermissionIssue > maxSlack:
 			// a lot of nanoseconds passed since the last Take call
 			// we will limit max accumulated time to maxSlack
-			newTimeOfNextPermissionIssue = now - int64(t.maxSlack)
+			issue = now - maxSlack
 		default:
 			// calculate the time at which our permission was issued
-			newTimeOfNextPermissionIssue = timeOfNextPermissionIssue + int64(t.perRequest)
+			issue = timeOfNextPermissionIssue + perRequest
 		}
+		// the rest n-1 permissions follow one by one
+		issue += (n - 1) * perRequest
 
-		if atomic.CompareAndSwapInt64(&t.state, timeOfNextPermissionIssue, newTimeOfNextPermissionIssue) {
-			break
+		if issue-now > int64(maxWait) {
+			return now, issue, false
+		}
+		if atomic.CompareAndSwapInt64(&t.state, timeOfNextPermissionIssue, issue) {
+			return now, issue, true
 		}
 	}
-	t.clock.Sleep(time.Duration(newTimeOfNextPermissionIssue - now))
-	return time.Unix(0, newTimeOfNextPermissionIssue)
 }
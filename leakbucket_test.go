@@ -1,6 +1,7 @@
 package ratelimit
 
 import (
+	"context"
 	"sync"
 	"testing"
 	"time"
@@ -330,3 +331,110 @@ func (r *runnerImpl) goWait(fn func()) {
 	}()
 	wg.Wait()
 }
+
+func TestWaitContextCancel(t *testing.T) {
+	t.Parallel()
+	clk := clock.NewMock()
+	clk.Set(time.Now())
+	rl := NewAtomicInt64Based(10, WithSlack(0), WithClock(clk))
+	assert.True(t, rl.Allow())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- rl.WaitContext(ctx, 1)
+	}()
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+
+	// the cancelled reservation was given back
+	clk.Add(100 * time.Millisecond)
+	assert.True(t, rl.Allow())
+	assert.False(t, rl.Allow())
+}
+
+func TestWaitContextDeadline(t *testing.T) {
+	t.Parallel()
+	clk := clock.NewMock()
+	clk.Set(time.Now())
+	rl := NewAtomicInt64Based(1, WithSlack(0), WithClock(clk))
+	assert.True(t, rl.Allow())
+
+	ctx := withMockDeadline(clk, 10*time.Millisecond)
+	assert.ErrorIs(t, rl.WaitContext(ctx, 1), context.DeadlineExceeded)
+
+	// nothing was reserved
+	clk.Add(time.Second)
+	assert.True(t, rl.Allow())
+}
+
+func TestLeakySetRate(t *testing.T) {
+	t.Parallel()
+	clk := clock.NewMock()
+	clk.Set(time.Now())
+	rl := NewAtomicInt64Based(10, WithSlack(0), WithClock(clk))
+	assert.True(t, rl.Allow())
+
+	rl.SetRate(1)
+	clk.Add(100 * time.Millisecond)
+	assert.False(t, rl.Allow())
+	clk.Add(900 * time.Millisecond)
+	assert.True(t, rl.Allow())
+
+	rl.SetRate(10)
+	clk.Add(100 * time.Millisecond)
+	assert.True(t, rl.Allow())
+	assert.False(t, rl.Allow())
+
+	assert.Panics(t, func() { rl.SetRate(0) })
+}
+
+func TestTakeN(t *testing.T) {
+	t.Parallel()
+	clk := clock.NewMock()
+	clk.Set(time.Now())
+	rl := NewAtomicInt64Based(10, WithSlack(0), WithClock(clk))
+
+	start := clk.Now()
+	done := make(chan time.Time)
+	go func() { done <- rl.TakeN(3) }()
+	for rl.Idle() {
+		time.Sleep(time.Millisecond)
+	}
+	// 第一个许可立即发放，剩下两个每 100ms 一个
+	for i := 0; i < 10; i++ {
+		clk.Add(50 * time.Millisecond)
+		select {
+		case issued := <-done:
+			assert.Equal(t, 200*time.Millisecond, issued.Sub(start))
+			assert.False(t, rl.Allow())
+			clk.Add(100 * time.Millisecond)
+			assert.True(t, rl.Allow())
+			return
+		default:
+		}
+	}
+	t.Fatal("TakeN did not return")
+}
+
+func TestReservationCancelKeepsLaterReservations(t *testing.T) {
+	t.Parallel()
+	clk := clock.NewMock()
+	clk.Set(time.Now())
+	rl := NewAtomicInt64Based(10, WithSlack(0), WithClock(clk))
+
+	rl.Reserve()
+	b := rl.Reserve()
+	c := rl.Reserve()
+	assert.Equal(t, 200*time.Millisecond, c.Delay())
+
+	// b 后面还有 c，不能把 b 的时间片再发出去
+	b.Cancel()
+	assert.Equal(t, 300*time.Millisecond, rl.Reserve().Delay())
+
+	// 最后一个预留可以还回去
+	e := rl.Reserve()
+	assert.Equal(t, 400*time.Millisecond, e.Delay())
+	e.Cancel()
+	assert.Equal(t, 400*time.Millisecond, rl.Reserve().Delay())
+}
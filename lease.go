@@ -0,0 +1,304 @@
+package ratelimit
+
+// 按批租用分布式限流器的令牌
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Refunder 可选接口，分布式限流器支持把拿到但没有用掉的令牌还回去
+type Refunder interface {
+	Refund(ctx context.Context, key string, n int64) error
+}
+
+// LeaseLimiter 一次从分布式限流器拿一批令牌放进本地的桶里，用完或者租期到了再去拿下一批，
+// 大部分请求不需要访问后端
+//
+// 下一批的大小按上一个租期内的消耗速度估算，限制在 [minSize, maxSize] 之间。
+// 代价是每个节点最多可能多占用 maxSize 个令牌，租期到了或者 Close 时没用完的令牌会还给实现了 Refunder 的后端。
+// 过期令牌的归还在后台进行，不占用请求的时间
+type LeaseLimiter struct {
+	remote     DistributedLimiter
+	clock      Clock
+	ttl        time.Duration
+	minSize    int64
+	maxSize    int64
+	errHandler func(key string, err error)
+
+	mu        sync.Mutex
+	leases    map[string]*lease
+	lastSweep time.Time
+	sweeping  bool
+	pending   sync.WaitGroup // 后台还没完成的归还
+}
+
+type lease struct {
+	mu      sync.Mutex
+	bucket  *Bucket // 不会自动补充令牌的桶
+	start   time.Time
+	expires time.Time
+	granted int64 // 这一批一共拿了多少
+	size    int64 // 下一批拿多少
+	limit   int64 // 后端返回的 Limit
+	dead    bool  // 已经被清理掉了，需要重新创建
+}
+
+type leaseOpt func(l *LeaseLimiter)
+
+// LeaseWithTTL 每一批令牌最多用多久，默认 1 秒
+func LeaseWithTTL(ttl time.Duration) leaseOpt {
+	return func(l *LeaseLimiter) {
+		l.ttl = ttl
+	}
+}
+
+// LeaseWithSize 每一批最少和最多拿多少，默认 1 和 100
+func LeaseWithSize(minSize, maxSize int64) leaseOpt {
+	return func(l *LeaseLimiter) {
+		l.minSize = minSize
+		l.maxSize = maxSize
+	}
+}
+
+// LeaseWithErrorHandler 后台归还令牌失败时调用，默认忽略
+func LeaseWithErrorHandler(h func(key string, err error)) leaseOpt {
+	return func(l *LeaseLimiter) {
+		l.errHandler = h
+	}
+}
+
+func LeaseWithClock(clock Clock) leaseOpt {
+	return func(l *LeaseLimiter) {
+		if clock == nil {
+			clock = realClock{}
+		}
+		l.clock = clock
+	}
+}
+
+func NewLeaseLimiter(remote DistributedLimiter, opts ...leaseOpt) *LeaseLimiter {
+	l := &LeaseLimiter{
+		remote:  remote,
+		clock:   realClock{},
+		ttl:     time.Second,
+		minSize: 1,
+		maxSize: 100,
+		leases:  map[string]*lease{},
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if l.ttl <= 0 {
+		panic("lease ttl is not > 0")
+	}
+	if l.minSize <= 0 || l.maxSize < l.minSize {
+		panic("lease size is not 0 < min <= max")
+	}
+	return l
+}
+
+var _ DistributedLimiter = (*LeaseLimiter)(nil)
+
+// Throttle 本地的令牌够用时直接放行，Remaining 为本地剩余的令牌
+func (l *LeaseLimiter) Throttle(ctx context.Context, key string, n int64) (Result, error) {
+	if n <= 0 {
+		return Result{Allowed: true, RetryAfter: -1}, nil
+	}
+	l.maybeSweep()
+	ls := l.lease(key)
+	defer ls.mu.Unlock()
+
+	now := l.clock.Now()
+	if ls.bucket != nil && now.Before(ls.expires) && ls.bucket.AllowN(n) {
+		return Result{Allowed: true, Limit: ls.limit, Remaining: ls.bucket.Available(), RetryAfter: -1}, nil
+	}
+
+	// 过期的令牌还回去，没过期但是不够用的留着和下一批一起用
+	var left int64
+	if ls.bucket != nil {
+		ls.size = l.nextSize(ls, now)
+		left = ls.bucket.Available()
+		if !now.Before(ls.expires) {
+			l.refundLater(key, left)
+			ls.bucket, left = nil, 0
+		}
+	}
+	need := n - left
+	size := ls.size
+	if size < need {
+		size = need
+	}
+
+	res, err := l.remote.Throttle(ctx, key, size)
+	if err == nil && !res.Allowed && size > need {
+		// 后端剩下的不够一整批，只拿这一次需要的
+		size = need
+		res, err = l.remote.Throttle(ctx, key, size)
+	}
+	if err != nil || !res.Allowed {
+		return res, err
+	}
+
+	ls.bucket = NewBucket(infinityDuration, left+size, BucketWithClock(l.clock))
+	ls.bucket.TakeAvailable(n)
+	ls.start, ls.expires = now, now.Add(l.ttl)
+	ls.granted = left + size
+	ls.limit = res.Limit
+	return Result{Allowed: true, Limit: res.Limit, Remaining: ls.bucket.Available(), RetryAfter: -1}, nil
+}
+
+// Close 把所有没用完的令牌还给后端，并等待后台的归还完成
+func (l *LeaseLimiter) Close(ctx context.Context) error {
+	defer l.pending.Wait()
+
+	l.mu.Lock()
+	leases := l.leases
+	l.leases = map[string]*lease{}
+	l.mu.Unlock()
+
+	var firstErr error
+	for key, ls := range leases {
+		ls.mu.Lock()
+		if ls.bucket != nil && l.clock.Now().Before(ls.expires) {
+			if err := l.refund(ctx, key, ls.bucket.Available()); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		ls.bucket = nil
+		ls.dead = true
+		ls.mu.Unlock()
+	}
+	return firstErr
+}
+
+// lease 返回时已经加锁
+func (l *LeaseLimiter) lease(key string) *lease {
+	for {
+		l.mu.Lock()
+		ls, ok := l.leases[key]
+		if !ok {
+			ls = &lease{size: l.minSize}
+			l.leases[key] = ls
+		}
+		l.mu.Unlock()
+
+		ls.mu.Lock()
+		if !ls.dead {
+			return ls
+		}
+		ls.mu.Unlock()
+		l.remove(key, ls)
+	}
+}
+
+func (l *LeaseLimiter) remove(key string, ls *lease) {
+	l.mu.Lock()
+	if l.leases[key] == ls {
+		delete(l.leases, key)
+	}
+	l.mu.Unlock()
+}
+
+// nextSize 上一批的消耗速度乘以租期，不超过后端一次最多能给的数量，否则整批都会被拒绝
+func (l *LeaseLimiter) nextSize(ls *lease, now time.Time) int64 {
+	used := ls.granted - ls.bucket.Available()
+	elapsed := now.Sub(ls.start)
+	if elapsed < l.ttl/10 {
+		// 很快就用完了，至少按十分之一个租期算，避免估算出特别大的值
+		elapsed = l.ttl / 10
+	}
+	if elapsed > l.ttl {
+		elapsed = l.ttl
+	}
+	size := int64(float64(used) * float64(l.ttl) / float64(elapsed))
+	if size < l.minSize {
+		size = l.minSize
+	}
+	if size > l.maxSize {
+		size = l.maxSize
+	}
+	if ls.limit > 0 && size > ls.limit {
+		size = ls.limit
+	}
+	return size
+}
+
+func (l *LeaseLimiter) refund(ctx context.Context, key string, n int64) error {
+	refunder, ok := l.remote.(Refunder)
+	if !ok || n <= 0 {
+		return nil
+	}
+	return refunder.Refund(ctx, key, n)
+}
+
+// refundLater 在后台归还令牌，不使用请求的 ctx，最多等一个租期
+func (l *LeaseLimiter) refundLater(key string, n int64) {
+	if _, ok := l.remote.(Refunder); !ok || n <= 0 {
+		return
+	}
+	l.pending.Add(1)
+	go func() {
+		defer l.pending.Done()
+		l.refundBackground(key, n)
+	}()
+}
+
+func (l *LeaseLimiter) refundBackground(key string, n int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), l.ttl)
+	defer cancel()
+	if err := l.refund(ctx, key, n); err != nil && l.errHandler != nil {
+		l.errHandler(key, err)
+	}
+}
+
+// maybeSweep 每个租期在后台清理一次已经过期的 key，同一时间只有一个清理在进行
+func (l *LeaseLimiter) maybeSweep() {
+	now := l.clock.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.sweeping || now.Sub(l.lastSweep) < l.ttl {
+		return
+	}
+	l.lastSweep = now
+	l.sweeping = true
+	l.pending.Add(1)
+	go func() {
+		defer l.pending.Done()
+		l.sweep(now)
+	}()
+}
+
+// sweep 把没用完的令牌还回去
+// 持有 l.mu 时不去拿 lease 的锁，Throttle 会在持有 lease 的锁时访问后端
+func (l *LeaseLimiter) sweep(now time.Time) {
+	l.mu.Lock()
+	leases := make(map[string]*lease, len(l.leases))
+	for key, ls := range l.leases {
+		leases[key] = ls
+	}
+	l.mu.Unlock()
+
+	for key, ls := range leases {
+		ls.mu.Lock()
+		if ls.dead || (ls.bucket != nil && now.Before(ls.expires)) {
+			ls.mu.Unlock()
+			continue
+		}
+		var left int64
+		if ls.bucket != nil {
+			left = ls.bucket.Available()
+			ls.bucket = nil
+		}
+		ls.dead = true
+		ls.mu.Unlock()
+
+		l.remove(key, ls)
+		l.refundBackground(key, left)
+	}
+
+	l.mu.Lock()
+	l.sweeping = false
+	l.mu.Unlock()
+}
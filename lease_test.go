@@ -0,0 +1,201 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testQuota 不会补充的配额，记录访问了多少次
+type testQuota struct {
+	mu      sync.Mutex
+	avail   int64
+	limit   int64 // 一次最多能拿多少，为 0 时按 1000 算
+	calls   int
+	refunds int
+}
+
+func (q *testQuota) Throttle(ctx context.Context, key string, n int64) (Result, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.calls++
+	limit := q.limit
+	if limit == 0 {
+		limit = 1000
+	}
+	if q.avail < n || n > limit {
+		return Result{Limit: limit, Remaining: q.avail, RetryAfter: -1}, nil
+	}
+	q.avail -= n
+	return Result{Allowed: true, Limit: limit, Remaining: q.avail, RetryAfter: -1}, nil
+}
+
+func (q *testQuota) Refund(ctx context.Context, key string, n int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.refunds++
+	q.avail += n
+	return nil
+}
+
+func TestLeaseLimiter(t *testing.T) {
+	quota := &testQuota{avail: 1000}
+	clk := clock.NewMock()
+	l := NewLeaseLimiter(quota, LeaseWithClock(clk), LeaseWithSize(1, 50))
+	ctx := context.Background()
+
+	// 每 10ms 一个请求，下一批的大小按消耗速度增长到一秒 100 个，但不超过 50
+	for i := 0; i < 200; i++ {
+		res, err := l.Throttle(ctx, "user1", 1)
+		require.NoError(t, err)
+		require.True(t, res.Allowed)
+		assert.Equal(t, int64(1000), res.Limit)
+		clk.Add(10 * time.Millisecond)
+	}
+	assert.Less(t, quota.calls, 15)
+	assert.LessOrEqual(t, 1000-quota.avail-200, int64(50))
+
+	// 关闭时把没用完的还回去
+	require.NoError(t, l.Close(ctx))
+	assert.Equal(t, int64(800), quota.avail)
+}
+
+func TestLeaseLimiterExhausted(t *testing.T) {
+	quota := &testQuota{avail: 25}
+	clk := clock.NewMock()
+	l := NewLeaseLimiter(quota, LeaseWithClock(clk), LeaseWithSize(10, 10))
+	ctx := context.Background()
+
+	allowed := 0
+	for i := 0; i < 40; i++ {
+		res, err := l.Throttle(ctx, "user1", 1)
+		require.NoError(t, err)
+		if res.Allowed {
+			allowed++
+		}
+	}
+	// 最后不够一整批时只拿需要的
+	assert.Equal(t, 25, allowed)
+	assert.Equal(t, int64(0), quota.avail)
+
+	res, err := l.Throttle(ctx, "user1", 1)
+	require.NoError(t, err)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, int64(1000), res.Limit)
+}
+
+func TestLeaseLimiterBackendLimit(t *testing.T) {
+	quota := &testQuota{avail: 1000, limit: 5}
+	clk := clock.NewMock()
+	l := NewLeaseLimiter(quota, LeaseWithClock(clk), LeaseWithSize(1, 50))
+	ctx := context.Background()
+
+	// 消耗速度估算出来的批大小超过后端的限制时，按后端的限制拿
+	for i := 0; i < 100; i++ {
+		res, err := l.Throttle(ctx, "user1", 1)
+		require.NoError(t, err)
+		require.True(t, res.Allowed)
+		clk.Add(time.Millisecond)
+	}
+	assert.LessOrEqual(t, 1000-quota.avail-100, int64(5))
+	assert.Less(t, quota.calls, 30)
+}
+
+func TestLeaseLimiterExpire(t *testing.T) {
+	quota := &testQuota{avail: 100}
+	clk := clock.NewMock()
+	l := NewLeaseLimiter(quota, LeaseWithClock(clk), LeaseWithSize(10, 10), LeaseWithTTL(time.Second))
+	ctx := context.Background()
+
+	res, err := l.Throttle(ctx, "user1", 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(9), res.Remaining)
+	assert.Equal(t, int64(90), quota.avail)
+
+	// 租期到了，剩下的 9 个还回去之后重新拿一批
+	clk.Add(time.Second)
+	res, err = l.Throttle(ctx, "user1", 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(9), res.Remaining)
+	l.pending.Wait()
+	assert.Equal(t, int64(89), quota.avail)
+	assert.Equal(t, 1, quota.refunds)
+
+	// 没有访问的 key 在下一个租期被清理
+	_, err = l.Throttle(ctx, "user2", 1)
+	require.NoError(t, err)
+	clk.Add(time.Second)
+	_, err = l.Throttle(ctx, "user1", 1)
+	require.NoError(t, err)
+	l.pending.Wait()
+	assert.Len(t, l.leases, 1)
+	assert.Equal(t, int64(87), quota.avail)
+}
+
+// failingRefund 归还总是失败
+type failingRefund struct {
+	testQuota
+}
+
+func (q *failingRefund) Refund(ctx context.Context, key string, n int64) error {
+	return errors.New("refund failed")
+}
+
+func TestLeaseLimiterRefundError(t *testing.T) {
+	quota := &failingRefund{testQuota{avail: 100}}
+	clk := clock.NewMock()
+	var mu sync.Mutex
+	var failed []string
+	l := NewLeaseLimiter(quota, LeaseWithClock(clk), LeaseWithSize(10, 10), LeaseWithErrorHandler(func(key string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		failed = append(failed, key)
+	}))
+	ctx := context.Background()
+
+	_, err := l.Throttle(ctx, "user1", 1)
+	require.NoError(t, err)
+	_, err = l.Throttle(ctx, "user2", 1)
+	require.NoError(t, err)
+
+	// 两个 key 过期的令牌都在后台归还，失败交给 errHandler，不影响请求
+	clk.Add(time.Second)
+	res, err := l.Throttle(ctx, "user1", 1)
+	require.NoError(t, err)
+	assert.True(t, res.Allowed)
+	l.pending.Wait()
+	assert.ElementsMatch(t, []string{"user1", "user2"}, failed)
+}
+
+func TestLeaseLimiterConcurrent(t *testing.T) {
+	quota := &testQuota{avail: 500}
+	l := NewLeaseLimiter(quota, LeaseWithSize(1, 20))
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				res, err := l.Throttle(context.Background(), "user1", 1)
+				if err == nil && res.Allowed {
+					mu.Lock()
+					allowed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	require.NoError(t, l.Close(context.Background()))
+	assert.Equal(t, 500, allowed)
+	assert.Equal(t, int64(0), quota.avail)
+}
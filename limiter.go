@@ -0,0 +1,220 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrExceedsLimit 一次要的许可超过了限流器一次最多能给的数量，等多久都拿不到
+var ErrExceedsLimit = errors.New("ratelimit: n exceeds limiter's limit")
+
+// Limiter 各种限流算法的统一接口
+//
+// Allow 系列不会阻塞，拿不到许可直接返回 false
+// Reserve 系列会预留许可，由调用方根据 Delay 自行决定等待，
+// ReserveMaxDuration 需要等待的时间超过 maxWait 时不预留也不修改限流器的状态
+// Wait 系列会阻塞直到拿到许可，n 超过一次最多能给的数量时返回 ErrExceedsLimit
+type Limiter interface {
+	Allow() bool
+	AllowN(n int64) bool
+	Reserve() *Reservation
+	ReserveN(n int64) *Reservation
+	ReserveMaxDuration(n int64, maxWait time.Duration) *Reservation
+	Wait() error
+	WaitN(n int64) error
+	WaitContext(ctx context.Context, n int64) error
+}
+
+// Reservation 一次预留的结果
+type Reservation struct {
+	ok        bool
+	clock     Clock
+	timeToAct time.Time // 预留的许可可以使用的时间
+	cancel    func()    // 归还预留的许可
+}
+
+// OK 是否预留成功
+func (r *Reservation) OK() bool {
+	return r.ok
+}
+
+// Delay 还需要等待多久才能使用预留的许可
+func (r *Reservation) Delay() time.Duration {
+	return r.DelayFrom(r.clock.Now())
+}
+
+// DelayFrom 从 t 开始算还需要等待多久
+// 预留失败时返回本来需要等待的时间，永远无法满足时返回一个极大的值
+func (r *Reservation) DelayFrom(t time.Time) time.Duration {
+	if !r.ok && r.timeToAct.IsZero() {
+		return infinityDuration
+	}
+	d := r.timeToAct.Sub(t)
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// Cancel 放弃这次预留，把还没到使用时间的许可还给限流器
+// 只有第一次调用有效
+func (r *Reservation) Cancel() {
+	if r.cancel == nil {
+		return
+	}
+	r.cancel()
+	r.cancel = nil
+}
+
+// Result 一次限流判定的结果，字段含义和 redis-cell 的 CL.THROTTLE 返回值一致
+type Result struct {
+	Allowed    bool
+	Limit      int64         // 一次最多能通过的请求数
+	Remaining  int64         // 剩余额度
+	RetryAfter time.Duration // 被拒绝时多久之后可以重试，放行或者永远无法满足时为 -1
+	ResetAfter time.Duration // 多久之后额度恢复到满
+}
+
+// Throttler 在一次操作里完成限流判定并返回当前状态，中间件用它生成限流相关的响应头
+type Throttler interface {
+	Throttle(n int64) Result
+}
+
+// DistributedLimiter 状态保存在外部服务(比如 redis)中的限流器，所有 key 共用一个实例
+// 访问后端失败时返回 error，由调用方决定放行还是拒绝
+type DistributedLimiter interface {
+	Throttle(ctx context.Context, key string, n int64) (Result, error)
+}
+
+// Wait 等到预留的许可可用，ctx 先结束时归还许可
+// 预留失败时，永远无法满足返回 ErrExceedsLimit，否则说明等待时间超过了限制，返回 context.DeadlineExceeded
+func (r *Reservation) Wait(ctx context.Context) error {
+	if !r.ok {
+		if r.timeToAct.IsZero() {
+			return ErrExceedsLimit
+		}
+		return context.DeadlineExceeded
+	}
+	d := r.Delay()
+	if d == 0 {
+		return nil
+	}
+	select {
+	case <-r.clock.After(d):
+		return nil
+	case <-ctx.Done():
+		r.Cancel()
+		return ctx.Err()
+	}
+}
+
+// waitBudget 根据 ctx 的截止时间计算最多能等多久，当前时间以限流器的 clock 为准
+func waitBudget(ctx context.Context, clock Clock) (time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return infinityDuration, nil
+	}
+	return deadline.Sub(clock.Now()), nil
+}
+
+////////////////////
+// 通过名字创建限流器
+////////////////////
+
+// LimiterConfig 创建限流器的通用参数，各算法按自己的语义进行解释
+type LimiterConfig struct {
+	Limit int64         // 每个周期允许通过的请求数
+	Per   time.Duration // 周期，默认为一秒
+	Burst int64         // 允许的突发量，为 0 时使用算法自己的默认值
+	Clock Clock
+}
+
+type LimiterFactory func(conf LimiterConfig) Limiter
+
+var (
+	factoryMu sync.RWMutex
+	factories = map[string]LimiterFactory{}
+)
+
+// RegisterLimiter 注册限流算法，重复注册会覆盖之前的
+func RegisterLimiter(name string, factory LimiterFactory) {
+	if factory == nil {
+		panic("ratelimit: register nil limiter factory")
+	}
+	factoryMu.Lock()
+	defer factoryMu.Unlock()
+	factories[name] = factory
+}
+
+// Limiters 返回已注册的算法名
+func Limiters() []string {
+	factoryMu.RLock()
+	defer factoryMu.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewLimiter 根据算法名创建限流器
+func NewLimiter(name string, conf LimiterConfig) (Limiter, error) {
+	factoryMu.RLock()
+	factory, ok := factories[name]
+	factoryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("ratelimit: unknown limiter %q", name)
+	}
+	if conf.Limit <= 0 {
+		return nil, fmt.Errorf("ratelimit: limit is not > 0")
+	}
+	if conf.Per <= 0 {
+		conf.Per = time.Second
+	}
+	if conf.Clock == nil {
+		conf.Clock = realClock{}
+	}
+	return factory(conf), nil
+}
+
+func init() {
+	RegisterLimiter("tokenbucket", func(conf LimiterConfig) Limiter {
+		capacity := conf.Burst
+		if capacity <= 0 {
+			capacity = conf.Limit
+		}
+		rate := float64(conf.Limit) / conf.Per.Seconds()
+		return NewBucket(conf.Per, capacity, BucketWithClock(conf.Clock), BucketWithRate(rate))
+	})
+	RegisterLimiter("leakybucket", func(conf LimiterConfig) Limiter {
+		opts := []leakOption{WithPer(conf.Per), WithClock(conf.Clock)}
+		if conf.Burst > 0 {
+			opts = append(opts, WithSlack(int(conf.Burst)))
+		}
+		return NewAtomicInt64Based(int(conf.Limit), opts...)
+	})
+	RegisterLimiter("gcra", func(conf LimiterConfig) Limiter {
+		opts := []leakOption{WithPer(conf.Per), WithClock(conf.Clock)}
+		if conf.Burst > 0 {
+			opts = append(opts, WithSlack(int(conf.Burst)))
+		}
+		return NewGCRA(int(conf.Limit), opts...)
+	})
+	RegisterLimiter("fixedwindow", func(conf LimiterConfig) Limiter {
+		return NewFixedWindow(conf.Limit, conf.Per, WindowWithClock(conf.Clock))
+	})
+	RegisterLimiter("slidingwindow", func(conf LimiterConfig) Limiter {
+		return NewSlidingWindow(conf.Limit, conf.Per, WindowWithClock(conf.Clock))
+	})
+	RegisterLimiter("slidinglog", func(conf LimiterConfig) Limiter {
+		return NewSlidingLog(conf.Limit, conf.Per, WindowWithClock(conf.Clock))
+	})
+}
@@ -0,0 +1,140 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiterRegistry(t *testing.T) {
+	assert.Contains(t, Limiters(), "tokenbucket")
+	assert.Contains(t, Limiters(), "leakybucket")
+
+	_, err := NewLimiter("unknown", LimiterConfig{Limit: 1})
+	assert.Error(t, err)
+	_, err = NewLimiter("tokenbucket", LimiterConfig{})
+	assert.Error(t, err)
+}
+
+func TestLimiterAllow(t *testing.T) {
+	for _, name := range []string{"tokenbucket", "leakybucket"} {
+		t.Run(name, func(t *testing.T) {
+			clk := clock.NewMock()
+			clk.Set(time.Now())
+			l, err := NewLimiter(name, LimiterConfig{Limit: 10, Burst: 1, Clock: clk})
+			require.NoError(t, err)
+
+			assert.True(t, l.Allow())
+			assert.False(t, l.Allow())
+
+			clk.Add(100 * time.Millisecond)
+			assert.True(t, l.Allow())
+			assert.False(t, l.AllowN(5))
+		})
+	}
+}
+
+func TestLimiterReserve(t *testing.T) {
+	for _, name := range []string{"tokenbucket", "leakybucket"} {
+		t.Run(name, func(t *testing.T) {
+			clk := clock.NewMock()
+			clk.Set(time.Now())
+			l, err := NewLimiter(name, LimiterConfig{Limit: 10, Burst: 1, Clock: clk})
+			require.NoError(t, err)
+
+			r := l.Reserve()
+			assert.True(t, r.OK())
+			assert.Equal(t, time.Duration(0), r.Delay())
+
+			assert.Equal(t, 100*time.Millisecond, l.Reserve().Delay())
+			r = l.Reserve()
+			assert.True(t, r.OK())
+			assert.Equal(t, 200*time.Millisecond, r.Delay())
+
+			clk.Add(50 * time.Millisecond)
+			assert.Equal(t, 150*time.Millisecond, r.Delay())
+		})
+	}
+}
+
+func TestLimiterReserveMaxDuration(t *testing.T) {
+	for _, name := range Limiters() {
+		t.Run(name, func(t *testing.T) {
+			clk := clock.NewMock()
+			clk.Set(time.Unix(0, 0).Add(1000 * time.Second))
+			l, err := NewLimiter(name, LimiterConfig{Limit: 10, Burst: 1, Clock: clk})
+			require.NoError(t, err)
+			for i := 0; l.Allow(); i++ {
+				require.Less(t, i, 100)
+			}
+
+			r := l.ReserveMaxDuration(1, 0)
+			assert.False(t, r.OK())
+			delay := r.Delay()
+			assert.Greater(t, delay, time.Duration(0))
+			assert.Less(t, delay, time.Hour)
+			// 被拒绝的预留没有修改状态
+			assert.Equal(t, delay, l.ReserveMaxDuration(1, delay-1).Delay())
+
+			r = l.ReserveMaxDuration(1, delay)
+			assert.True(t, r.OK())
+			assert.Equal(t, delay, r.Delay())
+		})
+	}
+}
+
+func TestLimiterWaitNExceedsLimit(t *testing.T) {
+	for _, name := range Limiters() {
+		if name == "leakybucket" {
+			// 漏桶一个接一个地发放许可，n 再大也能等到
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			clk := clock.NewMock()
+			clk.Set(time.Unix(0, 0).Add(1000 * time.Second))
+			l, err := NewLimiter(name, LimiterConfig{Limit: 2, Burst: 1, Clock: clk})
+			require.NoError(t, err)
+
+			assert.ErrorIs(t, l.WaitN(100), ErrExceedsLimit)
+			assert.ErrorIs(t, l.WaitContext(context.Background(), 100), ErrExceedsLimit)
+			// 被拒绝的请求没有占用额度
+			assert.NoError(t, l.Wait())
+		})
+	}
+}
+
+// mockDeadlineContext 截止时间是 mock clock 上的时间，不会按真实的时间超时
+type mockDeadlineContext struct {
+	context.Context
+	deadline time.Time
+}
+
+func (c mockDeadlineContext) Deadline() (time.Time, bool) {
+	return c.deadline, true
+}
+
+func withMockDeadline(clk *clock.Mock, d time.Duration) context.Context {
+	return mockDeadlineContext{Context: context.Background(), deadline: clk.Now().Add(d)}
+}
+
+// notifyClock 每次 After 都通知一下，用来确认请求已经开始等待了
+type notifyClock struct {
+	*clock.Mock
+	after chan time.Duration
+}
+
+func newNotifyClock() notifyClock {
+	clk := clock.NewMock()
+	clk.Set(time.Now())
+	return notifyClock{Mock: clk, after: make(chan time.Duration)}
+}
+
+func (c notifyClock) After(d time.Duration) <-chan time.Time {
+	ch := c.Mock.After(d)
+	c.after <- d
+	return ch
+}
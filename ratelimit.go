@@ -1,18 +1,15 @@
 package ratelimit
 
 import (
-	"fmt"
 	"net/http"
-	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/gin-gonic/gin"
 )
 
-
 type Clock interface {
 	Now() time.Time
 	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
 }
 
 type realClock struct{}
@@ -25,33 +22,427 @@ func (realClock) Sleep(d time.Duration) {
 	time.Sleep(d)
 }
 
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// 中间件的通用配置
+type middlewareConfig struct {
+	store       Store
+	keyFunc     KeyFunc
+	denyHandler DenyHandler
+	errHandler  ErrorHandler
+	costFunc    CostFunc
+	actualCost  ActualCostFunc
+	clock       Clock
+	policy      string // RateLimit-Policy 响应头，由各个中间件根据参数生成
+
+	// 只对排队等待的中间件生效
+	maxWait  time.Duration // 最多排队多久
+	maxQueue int64         // 最多同时有多少个请求在排队，0 表示不限制
+}
+
+// MiddlewareOption 中间件的配置项，gin 等框架的适配层也使用它
+type MiddlewareOption func(c *middlewareConfig)
+
+// MiddlewareWithStore 保存每个 key 对应限流器的地方，
+// 默认为不启动后台协程的 NewMemoryStore(StoreWithInlineCleanup())，只有按 key 限流的中间件才会创建。
+// 多个中间件可以共用一个 store，各自的 key 互不冲突
+func MiddlewareWithStore(store Store) MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.store = store
+	}
+}
+
+// MiddlewareWithKeyFunc 按什么维度限流，默认为完整的请求地址
+func MiddlewareWithKeyFunc(keyFunc KeyFunc) MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.keyFunc = keyFunc
+	}
+}
+
+// MiddlewareWithDenyHandler 自定义被限流时的响应，默认为 DefaultDenyHandler
+func MiddlewareWithDenyHandler(handler DenyHandler) MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.denyHandler = handler
+	}
+}
+
+// MiddlewareWithErrorHandler 访问分布式限流的后端失败，或者 KeyFunc、CostFunc 返回错误时的响应，默认为 DefaultErrorHandler
+func MiddlewareWithErrorHandler(handler ErrorHandler) MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.errHandler = handler
+	}
+}
+
+// MiddlewareWithClock 创建限流器以及计算等待时间使用的时钟，默认为真实的时间
+func MiddlewareWithClock(clock Clock) MiddlewareOption {
+	return func(c *middlewareConfig) {
+		if clock == nil {
+			clock = realClock{}
+		}
+		c.clock = clock
+	}
+}
+
+// MiddlewareWithMaxWait 需要排队的时间超过 maxWait 时直接拒绝，默认一直等
+func MiddlewareWithMaxWait(maxWait time.Duration) MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.maxWait = maxWait
+	}
+}
+
+// MiddlewareWithMaxQueue 排队的请求超过 maxQueue 个时直接拒绝，所有 key 一起计算
+func MiddlewareWithMaxQueue(maxQueue int64) MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.maxQueue = maxQueue
+	}
+}
+
+func newMiddlewareConfig(opts ...MiddlewareOption) middlewareConfig {
+	c := middlewareConfig{
+		keyFunc:     KeyByURL(),
+		denyHandler: DefaultDenyHandler,
+		errHandler:  DefaultErrorHandler,
+		clock:       realClock{},
+		maxWait:     infinityDuration,
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
 // 令牌桶
-func TokenBucketMiddleware(fillInterval time.Duration, cap, quantum int64) gin.HandlerFunc {
+func TokenBucketMiddleware(fillInterval time.Duration, cap, quantum int64, opts ...MiddlewareOption) func(http.Handler) http.Handler {
+	conf := newMiddlewareConfig(opts...)
+	conf.policy = quotaPolicy(cap, time.Duration(cap)*fillInterval/time.Duration(quantum))
 	bucket := &tokenBucket{
 		fillInterval: fillInterval,
 		cap:          cap,
 		quantum:      quantum,
-		data:         sync.Map{},
+		clock:        conf.clock,
+		data:         defaultStore(conf.store, conf.clock),
 	}
+	return allowMiddleware(conf, func(key string) Limiter {
+		return bucket.GetBucket(key)
+	})
+}
 
-	return func(c *gin.Context) {
-		if bucket.GetBucket(fmt.Sprint(c.Request.URL)).TakeAvailable(1) < 1 {
-			c.String(http.StatusForbidden, "rate limit...")
-			c.Abort()
-			return
-		}
-		c.Next()
+// 漏桶 一秒能过多少请求，qps
+func LeakyBucketMiddleware(rate int, opts ...MiddlewareOption) func(http.Handler) http.Handler {
+	conf := newMiddlewareConfig(opts...)
+	conf.policy = quotaPolicy(int64(rate), time.Second)
+	bucket := &leakyBucket{
+		rate:  rate,
+		clock: conf.clock,
+		data:  defaultStore(conf.store, conf.clock),
 	}
+	return waitMiddleware(conf, func(key string) Limiter {
+		return bucket.GetBucket(key)
+	})
 }
 
-// 漏桶 一秒能过多少请求，qps
-func LeakyBucketMiddleware(rate int) gin.HandlerFunc {
+// 分布式限流 比如 redis-cell，访问后端失败时交给 MiddlewareWithErrorHandler 处理，默认返回 503
+func DistributedMiddleware(limiter DistributedLimiter, opts ...MiddlewareOption) func(http.Handler) http.Handler {
+	conf := newMiddlewareConfig(opts...)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, ok := limitKey(w, r, conf, next)
+			if !ok {
+				return
+			}
+			cost, ok := requestCost(w, r, conf, next)
+			if !ok {
+				return
+			}
+			res, err := limiter.Throttle(r.Context(), key, cost)
+			if err != nil {
+				conf.errHandler(w, r, err)
+				return
+			}
+			setRateLimitHeaders(w.Header(), conf.policy, res)
+			if !res.Allowed {
+				conf.denyHandler(w, r, res)
+				return
+			}
+			if diff := serveAndSettle(conf, w, r, next, cost); diff != 0 {
+				settleDistributed(limiter, key, diff)
+			}
+		})
+	}
+}
+
+// TokenBuckets 每个 key 一个令牌桶，供 grpc 等其他协议的适配层使用，store 为 nil 时使用不需要 Close 的 MemoryStore
+func TokenBuckets(fillInterval time.Duration, cap, quantum int64, store Store) func(key string) Limiter {
+	store = defaultStore(store, nil)
+	bucket := &tokenBucket{
+		fillInterval: fillInterval,
+		cap:          cap,
+		quantum:      quantum,
+		data:         store,
+	}
+	return func(key string) Limiter {
+		return bucket.GetBucket(key)
+	}
+}
+
+// LeakyBuckets 每个 key 一个漏桶，store 为 nil 时使用不需要 Close 的 MemoryStore
+func LeakyBuckets(rate int, store Store) func(key string) Limiter {
+	store = defaultStore(store, nil)
 	bucket := &leakyBucket{
 		rate: rate,
-		data: sync.Map{},
+		data: store,
+	}
+	return func(key string) Limiter {
+		return bucket.GetBucket(key)
+	}
+}
+
+// ConcurrencyLimiters 每个 key 一个并发数限制，store 为 nil 时使用不需要 Close 的 MemoryStore
+func ConcurrencyLimiters(limit int64, store Store) func(key string) *ConcurrencyLimiter {
+	store = defaultStore(store, nil)
+	limiters := &concurrencyStore{
+		limit: limit,
+		data:  store,
+	}
+	return func(key string) *ConcurrencyLimiter {
+		return limiters.GetLimiter(key)
+	}
+}
+
+// 并发数 同时最多 limit 个请求在处理，其余的排队等待，
+// MiddlewareWithMaxWait(0) 时不排队直接拒绝，handler 返回或者 panic 时归还许可
+func ConcurrencyMiddleware(limit int64, opts ...MiddlewareOption) func(http.Handler) http.Handler {
+	conf := newMiddlewareConfig(opts...)
+	getLimiter := ConcurrencyLimiters(limit, defaultStore(conf.store, conf.clock))
+	var waiting int64
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, ok := limitKey(w, r, conf, next)
+			if !ok {
+				return
+			}
+			l := getLimiter(key)
+			if !acquireConcurrency(w, r, conf, l, &waiting) {
+				return
+			}
+			defer l.Release()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// GCRA 每 per 时间放行 rate 个请求，允许 burst 个突发，拿不到许可直接拒绝
+func GCRAMiddleware(rate, burst int, per time.Duration, opts ...MiddlewareOption) func(http.Handler) http.Handler {
+	conf := newMiddlewareConfig(opts...)
+	conf.policy = quotaPolicy(int64(burst)+1, time.Duration(burst+1)*per/time.Duration(rate))
+	store := &gcraStore{
+		rate:  rate,
+		burst: burst,
+		per:   per,
+		clock: conf.clock,
+		data:  defaultStore(conf.store, conf.clock),
+	}
+	return allowMiddleware(conf, func(key string) Limiter {
+		return store.GetGCRA(key)
+	})
+}
+
+// 固定窗口 每个窗口内最多通过 limit 个请求
+func FixedWindowMiddleware(limit int64, window time.Duration, opts ...MiddlewareOption) func(http.Handler) http.Handler {
+	conf := newMiddlewareConfig(opts...)
+	conf.policy = quotaPolicy(limit, window)
+	counter := &fixedWindow{
+		limit:  limit,
+		window: window,
+		clock:  conf.clock,
+		data:   defaultStore(conf.store, conf.clock),
+	}
+	return allowMiddleware(conf, func(key string) Limiter {
+		return counter.GetWindow(key)
+	})
+}
+
+// 滑动窗口计数器 按上一个窗口加权估算，内存占用小
+func SlidingWindowMiddleware(limit int64, window time.Duration, opts ...MiddlewareOption) func(http.Handler) http.Handler {
+	conf := newMiddlewareConfig(opts...)
+	conf.policy = quotaPolicy(limit, window)
+	counter := &slidingWindow{
+		limit:  limit,
+		window: window,
+		clock:  conf.clock,
+		data:   defaultStore(conf.store, conf.clock),
+	}
+	return allowMiddleware(conf, func(key string) Limiter {
+		return counter.GetWindow(key)
+	})
+}
+
+// 滑动窗口日志 任意 window 时间内最多通过 limit 个请求
+func SlidingLogMiddleware(limit int64, window time.Duration, opts ...MiddlewareOption) func(http.Handler) http.Handler {
+	conf := newMiddlewareConfig(opts...)
+	conf.policy = quotaPolicy(limit, window)
+	log := &slidingLog{
+		limit:  limit,
+		window: window,
+		clock:  conf.clock,
+		data:   defaultStore(conf.store, conf.clock),
+	}
+	return allowMiddleware(conf, func(key string) Limiter {
+		return log.GetLog(key)
+	})
+}
+
+// 拿不到许可直接拒绝
+func allowMiddleware(conf middlewareConfig, getLimiter func(key string) Limiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, ok := limitKey(w, r, conf, next)
+			if !ok {
+				return
+			}
+			cost, ok := requestCost(w, r, conf, next)
+			if !ok {
+				return
+			}
+			limiter := getLimiter(key)
+			res := Throttle(limiter, cost)
+			setRateLimitHeaders(w.Header(), conf.policy, res)
+			if !res.Allowed {
+				conf.denyHandler(w, r, res)
+				return
+			}
+			if diff := serveAndSettle(conf, w, r, next, cost); diff != 0 {
+				settle(limiter, diff)
+			}
+		})
+	}
+}
+
+// 排队等待直到拿到许可，等待时间或者排队人数超出限制时直接拒绝
+func waitMiddleware(conf middlewareConfig, getLimiter func(key string) Limiter) func(http.Handler) http.Handler {
+	var waiting int64
+	deny := func(w http.ResponseWriter, r *http.Request, res Result) {
+		setRateLimitHeaders(w.Header(), conf.policy, res)
+		conf.denyHandler(w, r, res)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, ok := limitKey(w, r, conf, next)
+			if !ok {
+				return
+			}
+			cost, ok := requestCost(w, r, conf, next)
+			if !ok {
+				return
+			}
+			maxWait, err := waitBudget(r.Context(), conf.clock)
+			if err != nil {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			if maxWait > conf.maxWait {
+				maxWait = conf.maxWait
+			}
+
+			limiter := getLimiter(key)
+			serve := func() {
+				if diff := serveAndSettle(conf, w, r, next, cost); diff != 0 {
+					settle(limiter, diff)
+				}
+			}
+			// 不用等的请求直接放行，不占排队的位置
+			rv := limiter.ReserveMaxDuration(cost, 0)
+			if rv.OK() {
+				serve()
+				return
+			}
+			// 被拒绝的预留不修改限流器的状态，不需要还回去
+			if delay := rv.Delay(); delay > maxWait || delay == infinityDuration {
+				deny(w, r, Result{RetryAfter: retryAfter(delay, maxWait)})
+				return
+			}
+			if conf.maxQueue > 0 {
+				if atomic.AddInt64(&waiting, 1) > conf.maxQueue {
+					atomic.AddInt64(&waiting, -1)
+					deny(w, r, Result{RetryAfter: rv.Delay()})
+					return
+				}
+			}
+			rv = limiter.ReserveMaxDuration(cost, maxWait)
+			if rv.OK() {
+				// 请求被取消时放弃排队，把预留的许可还回去
+				err = rv.Wait(r.Context())
+			}
+			if conf.maxQueue > 0 {
+				atomic.AddInt64(&waiting, -1)
+			}
+			if !rv.OK() {
+				deny(w, r, Result{RetryAfter: retryAfter(rv.Delay(), maxWait)})
+				return
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			serve()
+		})
+	}
+}
+
+// retryAfter 需要等待 delay 的请求被拒绝之后，多久再来就只需要等 maxWait，永远无法满足时为 -1
+func retryAfter(delay, maxWait time.Duration) time.Duration {
+	if delay == infinityDuration {
+		return -1
+	}
+	return delay - maxWait
+}
+
+// acquireConcurrency 拿一个并发许可，最多等 maxWait，排队的请求超过 maxQueue 个时直接拒绝
+// 返回 false 时已经写好了响应
+func acquireConcurrency(w http.ResponseWriter, r *http.Request, conf middlewareConfig, l *ConcurrencyLimiter, waiting *int64) bool {
+	if l.TryAcquire() {
+		return true
+	}
+	deny := func() bool {
+		conf.denyHandler(w, r, Result{RetryAfter: -1})
+		return false
+	}
+	if conf.maxWait <= 0 {
+		return deny()
+	}
+	if conf.maxQueue > 0 {
+		if atomic.AddInt64(waiting, 1) > conf.maxQueue {
+			atomic.AddInt64(waiting, -1)
+			return deny()
+		}
+		defer atomic.AddInt64(waiting, -1)
+	}
+
+	if err := l.acquire(r.Context(), conf.clock, conf.maxWait); err != nil {
+		if r.Context().Err() != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return false
+		}
+		return deny()
+	}
+	return true
+}
+
+// limitKey 取出限流的 key，ok 为 false 时请求已经处理完了(不限流直接放行或者出错)
+// 出错时交给 errHandler，不把错误信息返回给客户端
+func limitKey(w http.ResponseWriter, r *http.Request, conf middlewareConfig, next http.Handler) (string, bool) {
+	key, err := conf.keyFunc(r)
+	if err != nil {
+		conf.errHandler(w, r, err)
+		return "", false
 	}
-	return func(ctx *gin.Context) {
-		(bucket.GetBucket(fmt.Sprint(ctx.Request.URL))).Take()
-		ctx.Next()
+	if key == "" {
+		next.ServeHTTP(w, r)
+		return "", false
 	}
+	return key, true
 }
@@ -0,0 +1,107 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLeakyBucketMaxWait(t *testing.T) {
+	clk := clock.NewMock()
+	clk.Set(time.Now())
+	r := newTestHandler(LeakyBucketMiddleware(10, MiddlewareWithMaxWait(50*time.Millisecond), MiddlewareWithClock(clk)))
+
+	assert.Equal(t, http.StatusOK, doRequest(r, "/user/1", nil))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/user/1", nil))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get(HeaderRetryAfter))
+	assert.Equal(t, "10;w=1", w.Header().Get(HeaderRateLimitPolicy))
+
+	// the rejected request did not take the slot
+	clk.Add(100 * time.Millisecond)
+	assert.Equal(t, http.StatusOK, doRequest(r, "/user/1", nil))
+}
+
+func TestLeakyBucketMaxQueue(t *testing.T) {
+	clk := newNotifyClock()
+	r := newTestHandler(LeakyBucketMiddleware(1, MiddlewareWithMaxQueue(1), MiddlewareWithClock(clk)))
+	assert.Equal(t, http.StatusOK, doRequest(r, "/user/1", nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	queued := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/user/1", nil).WithContext(ctx))
+		queued <- w.Code
+	}()
+	// 开始排队了
+	<-clk.after
+
+	assert.Equal(t, http.StatusTooManyRequests, doRequest(r, "/user/1", nil))
+	cancel()
+	assert.Equal(t, http.StatusServiceUnavailable, <-queued)
+
+	// 排队被拒绝和放弃排队的请求都没有占用许可
+	clk.Add(time.Second)
+	assert.Equal(t, http.StatusOK, doRequest(r, "/user/1", nil))
+}
+
+func TestSharedStore(t *testing.T) {
+	store := NewMemoryStore(StoreWithInlineCleanup())
+	// 两个中间件用同一个 store 和同一个 key，各自限流
+	r := newTestHandler(TokenBucketMiddleware(time.Hour, 1, 1, MiddlewareWithStore(store)))
+	r = FixedWindowMiddleware(2, time.Hour, MiddlewareWithStore(store))(r)
+
+	assert.Equal(t, http.StatusOK, doRequest(r, "/user/1", nil))
+	assert.Equal(t, http.StatusTooManyRequests, doRequest(r, "/user/1", nil))
+	assert.Equal(t, http.StatusTooManyRequests, doRequest(r, "/user/1", nil))
+	assert.Equal(t, 2, store.Len())
+}
+
+// testDistributed 用本地的 GCRA 模拟后端，down 时返回错误
+type testDistributed struct {
+	store gcraStore
+	down  bool
+}
+
+func (d *testDistributed) Throttle(ctx context.Context, key string, n int64) (Result, error) {
+	if d.down {
+		return Result{}, errors.New("backend is down")
+	}
+	return d.store.GetGCRA(key).Throttle(n), nil
+}
+
+func TestDistributedMiddleware(t *testing.T) {
+	limiter := &testDistributed{store: gcraStore{rate: 1, burst: 1, per: time.Hour, data: defaultStore(nil, nil)}}
+	h := newTestHandler(DistributedMiddleware(limiter))
+
+	assert.Equal(t, http.StatusOK, doRequest(h, "/user/1", nil))
+	assert.Equal(t, http.StatusOK, doRequest(h, "/user/1", nil))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/user/1", nil))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get(HeaderXRateLimitLimit))
+	assert.Equal(t, "3600", w.Header().Get(HeaderRetryAfter))
+
+	// 后端的错误信息不返回给客户端
+	limiter.down = true
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/user/2", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.NotContains(t, w.Body.String(), "backend is down")
+
+	var reported error
+	h = newTestHandler(DistributedMiddleware(limiter, MiddlewareWithErrorHandler(func(w http.ResponseWriter, r *http.Request, err error) {
+		reported = err
+		DefaultErrorHandler(w, r, err)
+	})))
+	assert.Equal(t, http.StatusServiceUnavailable, doRequest(h, "/user/2", nil))
+	assert.EqualError(t, reported, "backend is down")
+}
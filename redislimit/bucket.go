@@ -0,0 +1,143 @@
+package redislimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/wwqdrh/ratelimit"
+)
+
+// tokenBucketScript 和 ratelimit.Bucket 的 Throttle 一样按 tick 放入令牌，时间使用 redis 服务端的时间(微秒)
+// KEYS[1] 桶 ARGV[1] fillInterval ARGV[2] capacity ARGV[3] quantum ARGV[4] 拿多少
+// 返回值同 CL.THROTTLE
+var tokenBucketScript = redis.NewScript(scriptPrelude + `
+local interval = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local quantum = tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+
+local state = redis.call('HMGET', KEYS[1], 'start', 'tokens', 'tick')
+local start = tonumber(state[1]) or now
+local tokens = tonumber(state[2]) or capacity
+local last = tonumber(state[3]) or 0
+
+local tick = math.floor((now - start) / interval)
+if tokens < capacity then
+	tokens = math.min(tokens + (tick - last) * quantum, capacity)
+end
+
+local function time_to(count)
+	local lack = count - tokens
+	if lack <= 0 then
+		return 0
+	end
+	return start + (tick + math.ceil(lack / quantum)) * interval - now
+end
+
+local limited = 1
+local retry = -1
+if n <= 0 or tokens >= n then
+	limited = 0
+	if n > 0 then
+		tokens = tokens - n
+	end
+elseif n <= capacity then
+	retry = time_to(n)
+end
+local reset = time_to(capacity)
+
+-- 桶满了之后和新建的没有区别，可以直接过期
+redis.call('HSET', KEYS[1], 'start', string.format('%.0f', start), 'tokens', tokens, 'tick', tick)
+redis.call('PEXPIRE', KEYS[1], math.max(math.ceil(reset / 1000), 1))
+return {limited, capacity, math.max(tokens, 0), retry, reset}
+`)
+
+// tokenBucketRefundScript 先按 tick 补充令牌再把 n 个还回去，最多到 capacity，桶不存在时已经是满的
+// KEYS[1] 桶 ARGV[1] fillInterval ARGV[2] capacity ARGV[3] quantum ARGV[4] 还多少
+var tokenBucketRefundScript = redis.NewScript(scriptPrelude + `
+local state = redis.call('HMGET', KEYS[1], 'start', 'tokens', 'tick')
+if not state[1] then
+	return 0
+end
+local interval = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local quantum = tonumber(ARGV[3])
+local start = tonumber(state[1])
+local tokens = tonumber(state[2])
+local tick = math.floor((now - start) / interval)
+tokens = math.min(tokens + (tick - tonumber(state[3])) * quantum + tonumber(ARGV[4]), capacity)
+
+local reset = 0
+if tokens < capacity then
+	reset = start + (tick + math.ceil((capacity - tokens) / quantum)) * interval - now
+end
+redis.call('HSET', KEYS[1], 'tokens', tokens, 'tick', tick)
+redis.call('PEXPIRE', KEYS[1], math.max(math.ceil(reset / 1000), 1))
+return 1
+`)
+
+// TokenBucket 状态保存在 redis 中的令牌桶，行为和 ratelimit.Bucket 一致:
+// 每 fillInterval 放入 quantum 个令牌，最多存 capacity 个
+// 桶满了之后 key 会过期，重新创建时 tick 从新的时间开始算，放入令牌的时间点和一直存在的桶最多相差一个 fillInterval
+type TokenBucket struct {
+	client redis.UniversalClient
+	prefix string
+
+	fillInterval time.Duration
+	capacity     int64
+	quantum      int64
+}
+
+type tokenBucketOpt func(b *TokenBucket)
+
+// TokenBucketWithPrefix key 的前缀，默认为 ratelimit:bucket:
+func TokenBucketWithPrefix(prefix string) tokenBucketOpt {
+	return func(b *TokenBucket) {
+		b.prefix = prefix
+	}
+}
+
+// NewTokenBucket fillInterval 的精度为微秒
+func NewTokenBucket(client redis.UniversalClient, fillInterval time.Duration, capacity, quantum int64, opts ...tokenBucketOpt) *TokenBucket {
+	if fillInterval < time.Microsecond {
+		panic("redis token bucket fill interval is not >= 1µs")
+	}
+	if capacity <= 0 {
+		panic("redis token bucket capacity is not > 0")
+	}
+	if quantum <= 0 {
+		panic("redis token bucket quantum is not > 0")
+	}
+	b := &TokenBucket{
+		client:       client,
+		prefix:       "ratelimit:bucket:",
+		fillInterval: fillInterval,
+		capacity:     capacity,
+		quantum:      quantum,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+var _ ratelimit.DistributedLimiter = (*TokenBucket)(nil)
+
+// Throttle 脚本通过 EVALSHA 执行，redis 中没有缓存时自动使用 EVAL
+func (b *TokenBucket) Throttle(ctx context.Context, key string, n int64) (ratelimit.Result, error) {
+	reply, err := tokenBucketScript.Run(ctx, b.client, []string{b.prefix + key},
+		b.fillInterval.Microseconds(), b.capacity, b.quantum, n).Int64Slice()
+	if err != nil {
+		return ratelimit.Result{}, err
+	}
+	return toResult(reply, time.Microsecond)
+}
+
+var _ ratelimit.Refunder = (*TokenBucket)(nil)
+
+// Refund 把拿到但没用掉的令牌还回去，最多到 capacity
+func (b *TokenBucket) Refund(ctx context.Context, key string, n int64) error {
+	return tokenBucketRefundScript.Run(ctx, b.client, []string{b.prefix + key},
+		b.fillInterval.Microseconds(), b.capacity, b.quantum, n).Err()
+}
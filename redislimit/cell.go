@@ -0,0 +1,67 @@
+package redislimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/wwqdrh/ratelimit"
+)
+
+// Cell 使用 redis-cell 模块的 CL.THROTTLE 命令，需要先在 redis 中加载模块，参考 scripts/redis-cell.sh
+//
+//	CL.THROTTLE key burst count period quantity
+//
+// 每 period 时间放行 count 个请求，允许 burst 个突发，和本地的 ratelimit.GCRA 语义一致
+type Cell struct {
+	client redis.UniversalClient
+	prefix string
+
+	burst  int64
+	count  int64
+	period int64 // 秒
+}
+
+type cellOpt func(c *Cell)
+
+// CellWithPrefix key 的前缀，默认为 ratelimit:cell:
+func CellWithPrefix(prefix string) cellOpt {
+	return func(c *Cell) {
+		c.prefix = prefix
+	}
+}
+
+// NewCell period 的精度为秒
+func NewCell(client redis.UniversalClient, burst, count int64, period time.Duration, opts ...cellOpt) *Cell {
+	if burst < 0 {
+		panic("redis cell burst is not >= 0")
+	}
+	if count <= 0 {
+		panic("redis cell count is not > 0")
+	}
+	if period < time.Second {
+		panic("redis cell period is not >= 1s")
+	}
+	c := &Cell{
+		client: client,
+		prefix: "ratelimit:cell:",
+		burst:  burst,
+		count:  count,
+		period: int64(period / time.Second),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+var _ ratelimit.DistributedLimiter = (*Cell)(nil)
+
+// Throttle 返回值的时间单位为秒
+func (c *Cell) Throttle(ctx context.Context, key string, n int64) (ratelimit.Result, error) {
+	reply, err := c.client.Do(ctx, "CL.THROTTLE", c.prefix+key, c.burst, c.count, c.period, n).Int64Slice()
+	if err != nil {
+		return ratelimit.Result{}, err
+	}
+	return toResult(reply, time.Second)
+}
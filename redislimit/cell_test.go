@@ -0,0 +1,189 @@
+package redislimit
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wwqdrh/ratelimit"
+)
+
+// fakeCell 只认识 CL.THROTTLE 的 RESP 服务，用本地的 GCRA 模拟 redis-cell
+type fakeCell struct {
+	lis   net.Listener
+	clock *clock.Mock
+
+	mu    sync.Mutex
+	cells map[string]*ratelimit.GCRA
+}
+
+func newFakeCell(t *testing.T) *fakeCell {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &fakeCell{lis: lis, clock: clock.NewMock(), cells: map[string]*ratelimit.GCRA{}}
+	go s.serve()
+	t.Cleanup(func() { lis.Close() })
+	return s
+}
+
+func (s *fakeCell) client(t *testing.T) redis.UniversalClient {
+	client := redis.NewClient(&redis.Options{Addr: s.lis.Addr().String(), MaxRetries: -1})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func (s *fakeCell) serve() {
+	for {
+		conn, err := s.lis.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeCell) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		if _, err := io.WriteString(conn, s.exec(args)); err != nil {
+			return
+		}
+	}
+}
+
+// readCommand 解析 *N\r\n$len\r\narg\r\n... 形式的命令
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if _, err := r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return args, nil
+}
+
+func (s *fakeCell) exec(args []string) string {
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "CL.THROTTLE":
+	default:
+		return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+	}
+	if len(args) != 6 {
+		return "-ERR wrong number of arguments for 'CL.THROTTLE'\r\n"
+	}
+	nums := make([]int, 4)
+	for i := range nums {
+		n, err := strconv.Atoi(args[i+2])
+		if err != nil {
+			return "-ERR value is not an integer\r\n"
+		}
+		nums[i] = n
+	}
+	burst, count, period, quantity := nums[0], nums[1], nums[2], nums[3]
+
+	s.mu.Lock()
+	cell, ok := s.cells[args[1]]
+	if !ok {
+		cell = ratelimit.NewGCRA(count, ratelimit.WithSlack(burst), ratelimit.WithPer(time.Duration(period)*time.Second), ratelimit.WithClock(s.clock))
+		s.cells[args[1]] = cell
+	}
+	s.mu.Unlock()
+
+	res := cell.Throttle(int64(quantity))
+	limited, retryAfter := 1, int64(-1)
+	if res.Allowed {
+		limited = 0
+	} else if res.RetryAfter >= 0 {
+		retryAfter = int64(res.RetryAfter / time.Second)
+	}
+	return fmt.Sprintf("*5\r\n:%d\r\n:%d\r\n:%d\r\n:%d\r\n:%d\r\n",
+		limited, res.Limit, res.Remaining, retryAfter, int64(res.ResetAfter/time.Second))
+}
+
+func TestCell(t *testing.T) {
+	s := newFakeCell(t)
+	cell := NewCell(s.client(t), 2, 1, 10*time.Second)
+	ctx := context.Background()
+
+	for i := int64(2); i >= 0; i-- {
+		res, err := cell.Throttle(ctx, "user1", 1)
+		require.NoError(t, err)
+		assert.Equal(t, ratelimit.Result{Allowed: true, Limit: 3, Remaining: i, RetryAfter: -1, ResetAfter: time.Duration(30-i*10) * time.Second}, res)
+	}
+	res, err := cell.Throttle(ctx, "user1", 1)
+	require.NoError(t, err)
+	assert.Equal(t, ratelimit.Result{Allowed: false, Limit: 3, Remaining: 0, RetryAfter: 10 * time.Second, ResetAfter: 30 * time.Second}, res)
+
+	// 一次要的比突发量还多，永远无法满足
+	res, err = cell.Throttle(ctx, "user2", 4)
+	require.NoError(t, err)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, time.Duration(-1), res.RetryAfter)
+
+	s.clock.Add(10 * time.Second)
+	res, err = cell.Throttle(ctx, "user1", 1)
+	require.NoError(t, err)
+	assert.True(t, res.Allowed)
+	_, ok := s.cells["ratelimit:cell:user1"]
+	assert.True(t, ok)
+}
+
+func TestCellError(t *testing.T) {
+	s := newFakeCell(t)
+	cell := NewCell(s.client(t), 2, 1, time.Second)
+	_, err := cell.Throttle(context.Background(), "user1", 1)
+	assert.NoError(t, err)
+
+	// 连接断开之后返回错误，由调用方决定怎么处理
+	s.lis.Close()
+	_, err = NewCell(s.client(t), 2, 1, time.Second).Throttle(context.Background(), "user1", 1)
+	assert.Error(t, err)
+}
+
+func TestCellMiddleware(t *testing.T) {
+	s := newFakeCell(t)
+	h := ratelimit.DistributedMiddleware(NewCell(s.client(t), 0, 1, time.Minute))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/user/1", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "1", w.Header().Get(ratelimit.HeaderXRateLimitLimit))
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/user/1", nil))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "60", w.Header().Get(ratelimit.HeaderRetryAfter))
+}
@@ -0,0 +1,131 @@
+package redislimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/wwqdrh/ratelimit"
+)
+
+// gcraScript 和 ratelimit.GCRA 的 Throttle 一样只保存理论到达时间(TAT)，时间使用 redis 服务端的时间(微秒)
+// KEYS[1] TAT ARGV[1] emissionInterval ARGV[2] tolerance ARGV[3] limit ARGV[4] 拿多少
+// 返回值同 CL.THROTTLE
+var gcraScript = redis.NewScript(scriptPrelude + `
+local emission = tonumber(ARGV[1])
+local tolerance = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+
+local tat = tonumber(redis.call('GET', KEYS[1]) or now)
+if tat < now then
+	tat = now
+end
+local increment = emission * n
+local new_tat = tat + increment
+local diff = now - (new_tat - tolerance)
+
+local limited = 1
+local retry = -1
+local ttl
+if diff < 0 then
+	-- 一次要的比突发量还多时永远无法满足，不给重试时间
+	if increment <= tolerance then
+		retry = -diff
+	end
+	ttl = tat - now
+else
+	limited = 0
+	ttl = new_tat - now
+	if n > 0 then
+		redis.call('SET', KEYS[1], string.format('%.0f', new_tat), 'PX', math.max(math.ceil(ttl / 1000), 1))
+	end
+end
+
+local remaining = 0
+if tolerance - ttl > 0 then
+	remaining = math.floor((tolerance - ttl) / emission)
+end
+return {limited, limit, remaining, retry, ttl}
+`)
+
+// gcraRefundScript TAT 往回退 n 个间隔，最早退到当前时间
+// KEYS[1] TAT ARGV[1] emissionInterval ARGV[2] 还多少
+var gcraRefundScript = redis.NewScript(scriptPrelude + `
+local tat = tonumber(redis.call('GET', KEYS[1]))
+if not tat then
+	return 0
+end
+tat = tat - tonumber(ARGV[1]) * tonumber(ARGV[2])
+if tat <= now then
+	redis.call('DEL', KEYS[1])
+	return 1
+end
+redis.call('SET', KEYS[1], string.format('%.0f', tat), 'PX', math.max(math.ceil((tat - now) / 1000), 1))
+return 1
+`)
+
+// GCRA 状态保存在 redis 中的 GCRA，行为和 ratelimit.GCRA 一致:
+// 每 per 时间放行 rate 个请求，允许 burst 个突发
+type GCRA struct {
+	client redis.UniversalClient
+	prefix string
+
+	emissionInterval time.Duration
+	tolerance        time.Duration
+	limit            int64
+}
+
+type gcraOpt func(g *GCRA)
+
+// GCRAWithPrefix key 的前缀，默认为 ratelimit:gcra:
+func GCRAWithPrefix(prefix string) gcraOpt {
+	return func(g *GCRA) {
+		g.prefix = prefix
+	}
+}
+
+// NewGCRA per/rate 的精度为微秒
+func NewGCRA(client redis.UniversalClient, rate, burst int, per time.Duration, opts ...gcraOpt) *GCRA {
+	if rate <= 0 {
+		panic("redis gcra rate is not > 0")
+	}
+	if burst < 0 {
+		panic("redis gcra burst is not >= 0")
+	}
+	emissionInterval := per / time.Duration(rate)
+	if emissionInterval < time.Microsecond {
+		panic("redis gcra emission interval is not >= 1µs")
+	}
+	g := &GCRA{
+		client:           client,
+		prefix:           "ratelimit:gcra:",
+		emissionInterval: emissionInterval,
+		tolerance:        emissionInterval * time.Duration(burst+1),
+		limit:            int64(burst) + 1,
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	return g
+}
+
+var _ ratelimit.DistributedLimiter = (*GCRA)(nil)
+
+// Throttle 脚本通过 EVALSHA 执行，redis 中没有缓存时自动使用 EVAL
+func (g *GCRA) Throttle(ctx context.Context, key string, n int64) (ratelimit.Result, error) {
+	reply, err := gcraScript.Run(ctx, g.client, []string{g.prefix + key},
+		g.emissionInterval.Microseconds(), g.tolerance.Microseconds(), g.limit, n).Int64Slice()
+	if err != nil {
+		return ratelimit.Result{}, err
+	}
+	return toResult(reply, time.Microsecond)
+}
+
+var _ ratelimit.Refunder = (*GCRA)(nil)
+
+// Refund 把拿到但没用掉的许可还回去
+func (g *GCRA) Refund(ctx context.Context, key string, n int64) error {
+	return gcraRefundScript.Run(ctx, g.client, []string{g.prefix + key},
+		g.emissionInterval.Microseconds(), n).Err()
+}
@@ -0,0 +1,39 @@
+// Package redislimit 基于 redis 的分布式限流，实现了 ratelimit.DistributedLimiter
+//
+// Cell 依赖 redis-cell 模块，TokenBucket 和 GCRA 只用到 lua 脚本，任何 redis 都可以使用
+package redislimit
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/wwqdrh/ratelimit"
+)
+
+// scriptPrelude 所有脚本的开头，now 为 redis 服务端的时间(微秒)
+//
+// 脚本里调用了 TIME 这种结果不确定的命令，redis 5 之前默认把整个脚本复制给从库和 AOF，
+// 调用 TIME 之后再写会被拒绝，需要先用 replicate_commands 改成按命令复制，redis 5 及以后默认就是这样
+const scriptPrelude = `
+redis.replicate_commands()
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+`
+
+// toResult reply 依次为 是否被限流 limit remaining retry_after reset_after，时间的单位为 unit
+func toResult(reply []int64, unit time.Duration) (ratelimit.Result, error) {
+	if len(reply) != 5 {
+		return ratelimit.Result{}, fmt.Errorf("redislimit: unexpected reply %v", reply)
+	}
+	res := ratelimit.Result{
+		Allowed:    reply[0] == 0,
+		Limit:      reply[1],
+		Remaining:  reply[2],
+		RetryAfter: -1,
+		ResetAfter: time.Duration(reply[4]) * unit,
+	}
+	if reply[3] >= 0 {
+		res.RetryAfter = time.Duration(reply[3]) * unit
+	}
+	return res, nil
+}
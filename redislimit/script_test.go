@@ -0,0 +1,160 @@
+package redislimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/benbjohnson/clock"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wwqdrh/ratelimit"
+)
+
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, redis.UniversalClient) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return mr, client
+}
+
+// step 时间前进 advance 之后拿 n 个
+type step struct {
+	advance time.Duration
+	n       int64
+}
+
+var steps = []step{
+	{0, 1}, {0, 2}, {0, 3}, {10 * time.Millisecond, 2}, {0, 1},
+	{150 * time.Millisecond, 2}, {0, 4}, {50 * time.Millisecond, 1}, {0, 6},
+	{time.Second, 5}, {time.Second, 0}, {30 * time.Millisecond, 5}, {0, 1},
+}
+
+// compareWithLocal 用 miniredis 的时间模拟 redis 服务端的时间，和本地的限流器逐步比较结果
+func compareWithLocal(t *testing.T, mr *miniredis.Miniredis, clk *clock.Mock, local ratelimit.Throttler, remote ratelimit.DistributedLimiter) {
+	for i, s := range steps {
+		clk.Add(s.advance)
+		mr.SetTime(clk.Now())
+		want := local.Throttle(s.n)
+		got, err := remote.Throttle(context.Background(), "user1", s.n)
+		require.NoError(t, err)
+		assert.Equal(t, want, got, "step %d: %+v", i, s)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	mr, client := newTestRedis(t)
+	clk := clock.NewMock()
+	clk.Set(time.Unix(1700000000, 0))
+	mr.SetTime(clk.Now())
+
+	local := ratelimit.NewBucket(100*time.Millisecond, 5, ratelimit.BucketWithQuantum(2), ratelimit.BucketWithClock(clk))
+	compareWithLocal(t, mr, clk, local, NewTokenBucket(client, 100*time.Millisecond, 5, 2))
+	assert.True(t, mr.Exists("ratelimit:bucket:user1"))
+}
+
+func TestGCRA(t *testing.T) {
+	mr, client := newTestRedis(t)
+	clk := clock.NewMock()
+	clk.Set(time.Unix(1700000000, 0))
+	mr.SetTime(clk.Now())
+
+	local := ratelimit.NewGCRA(10, ratelimit.WithSlack(4), ratelimit.WithClock(clk))
+	compareWithLocal(t, mr, clk, local, NewGCRA(client, 10, 4, time.Second))
+	assert.True(t, mr.Exists("ratelimit:gcra:user1"))
+}
+
+func TestScriptExpire(t *testing.T) {
+	mr, client := newTestRedis(t)
+	ctx := context.Background()
+
+	b := NewTokenBucket(client, time.Second, 3, 1)
+	_, err := b.Throttle(ctx, "user1", 2)
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Second, mr.TTL("ratelimit:bucket:user1"))
+
+	g := NewGCRA(client, 1, 2, time.Second)
+	_, err = g.Throttle(ctx, "user1", 2)
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Second, mr.TTL("ratelimit:gcra:user1"))
+
+	// 过期之后额度是满的
+	mr.FastForward(2 * time.Second)
+	assert.False(t, mr.Exists("ratelimit:bucket:user1"))
+	assert.False(t, mr.Exists("ratelimit:gcra:user1"))
+}
+
+func TestScriptNoScript(t *testing.T) {
+	_, client := newTestRedis(t)
+	ctx := context.Background()
+	b := NewTokenBucket(client, time.Second, 3, 1)
+
+	_, err := b.Throttle(ctx, "user1", 1)
+	require.NoError(t, err)
+	loaded, err := client.ScriptExists(ctx, tokenBucketScript.Hash()).Result()
+	require.NoError(t, err)
+	assert.Equal(t, []bool{true}, loaded)
+
+	// redis 重启或者执行了 SCRIPT FLUSH 之后自动重新加载
+	require.NoError(t, client.ScriptFlush(ctx).Err())
+	res, err := b.Throttle(ctx, "user1", 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), res.Remaining)
+}
+
+func TestRefund(t *testing.T) {
+	mr, client := newTestRedis(t)
+	mr.SetTime(time.Unix(1700000000, 0))
+	ctx := context.Background()
+
+	b := NewTokenBucket(client, time.Second, 5, 1)
+	_, err := b.Throttle(ctx, "user1", 4)
+	require.NoError(t, err)
+	require.NoError(t, b.Refund(ctx, "user1", 3))
+	res, err := b.Throttle(ctx, "user1", 0)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), res.Remaining)
+	require.NoError(t, b.Refund(ctx, "user1", 10))
+	res, err = b.Throttle(ctx, "user1", 0)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), res.Remaining)
+	assert.Equal(t, time.Duration(0), res.ResetAfter)
+
+	g := NewGCRA(client, 1, 2, time.Second)
+	_, err = g.Throttle(ctx, "user1", 3)
+	require.NoError(t, err)
+	require.NoError(t, g.Refund(ctx, "user1", 2))
+	res, err = g.Throttle(ctx, "user1", 0)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), res.Remaining)
+	require.NoError(t, g.Refund(ctx, "user1", 5))
+	assert.False(t, mr.Exists("ratelimit:gcra:user1"))
+
+	// 不存在的 key 已经是满的
+	require.NoError(t, b.Refund(ctx, "user2", 1))
+	require.NoError(t, g.Refund(ctx, "user2", 1))
+	assert.False(t, mr.Exists("ratelimit:bucket:user2"))
+}
+
+func TestLeaseLimiterRedis(t *testing.T) {
+	_, client := newTestRedis(t)
+	ctx := context.Background()
+	b := NewTokenBucket(client, time.Hour, 100, 1)
+	l := ratelimit.NewLeaseLimiter(b, ratelimit.LeaseWithSize(20, 20))
+
+	for i := 0; i < 5; i++ {
+		res, err := l.Throttle(ctx, "user1", 1)
+		require.NoError(t, err)
+		assert.True(t, res.Allowed)
+	}
+	res, err := b.Throttle(ctx, "user1", 0)
+	require.NoError(t, err)
+	assert.Equal(t, int64(80), res.Remaining)
+
+	require.NoError(t, l.Close(ctx))
+	res, err = b.Throttle(ctx, "user1", 0)
+	require.NoError(t, err)
+	assert.Equal(t, int64(95), res.Remaining)
+}
@@ -0,0 +1,202 @@
+package registry
+
+// 基于 redis 的中心节点
+//
+// 每个节点保存为一个 hash，带有过期时间，节点挂掉之后不再续期就会自动消失
+// 所有节点的地址另外保存在一个 set 中，读取时顺便清理已经过期的节点
+// key 都带有相同的 hash tag，在 redis cluster 中也能在同一个 lua 脚本里操作多个节点
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	fieldCap       = "cap"
+	fieldAvaliable = "avaliable"
+)
+
+// borrowScript KEYS[1] 借入的节点 KEYS[2] 借出的节点 ARGV[1] 借多少 ARGV[2] 过期时间(毫秒)
+var borrowScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 or redis.call('EXISTS', KEYS[2]) == 0 then
+	return 0
+end
+local n = tonumber(ARGV[1])
+local target = tonumber(redis.call('HGET', KEYS[2], 'cap') or '0')
+if target < n then
+	return 0
+end
+redis.call('HINCRBY', KEYS[2], 'cap', -n)
+redis.call('HINCRBY', KEYS[1], 'cap', n)
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return 1
+`)
+
+// setCapScript KEYS[1] 节点 ARGV[1] 容量 ARGV[2] 过期时间(毫秒)
+var setCapScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'cap', ARGV[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return 1
+`)
+
+// reportScript KEYS[1] 节点 ARGV[1] 可用量 ARGV[2] 过期时间(毫秒)
+var reportScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'avaliable', ARGV[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return 1
+`)
+
+type RedisRegistry struct {
+	client redis.UniversalClient
+	prefix string
+	ttl    time.Duration
+}
+
+type redisOpt func(r *RedisRegistry)
+
+// RedisWithPrefix key 的前缀，默认为 ratelimit
+func RedisWithPrefix(prefix string) redisOpt {
+	return func(r *RedisRegistry) {
+		r.prefix = prefix
+	}
+}
+
+// RedisWithTTL 节点多久没有续期就认为已经挂掉了，默认 30 秒
+func RedisWithTTL(ttl time.Duration) redisOpt {
+	return func(r *RedisRegistry) {
+		r.ttl = ttl
+	}
+}
+
+func NewRedisRegistry(client redis.UniversalClient, opts ...redisOpt) *RedisRegistry {
+	r := &RedisRegistry{
+		client: client,
+		prefix: "ratelimit",
+		ttl:    30 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if r.ttl <= 0 {
+		panic("redis registry ttl is not > 0")
+	}
+	return r
+}
+
+var (
+	_ IRegistry = (*RedisRegistry)(nil)
+	_ IReporter = (*RedisRegistry)(nil)
+)
+
+func (r *RedisRegistry) Initial(info NodeInfo) bool {
+	ctx := context.Background()
+	key := r.nodeKey(info.Addr)
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, fieldCap, info.Cap, fieldAvaliable, info.Avaliable)
+		pipe.PExpire(ctx, key, r.ttl)
+		pipe.SAdd(ctx, r.nodesKey(), info.Addr)
+		return nil
+	})
+	return err == nil
+}
+
+// AllNodeInfo 只返回还没有过期的节点
+func (r *RedisRegistry) AllNodeInfo() []NodeInfo {
+	ctx := context.Background()
+	res := []NodeInfo{}
+	addrs, err := r.client.SMembers(ctx, r.nodesKey()).Result()
+	if err != nil || len(addrs) == 0 {
+		return res
+	}
+
+	cmds := make([]*redis.SliceCmd, len(addrs))
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, addr := range addrs {
+			cmds[i] = pipe.HMGet(ctx, r.nodeKey(addr), fieldCap, fieldAvaliable)
+		}
+		return nil
+	})
+	if err != nil {
+		return res
+	}
+
+	expired := []interface{}{}
+	for i, cmd := range cmds {
+		vals := cmd.Val()
+		if len(vals) != 2 || vals[0] == nil {
+			expired = append(expired, addrs[i])
+			continue
+		}
+		res = append(res, NodeInfo{
+			Addr:      addrs[i],
+			Cap:       atoi(vals[0]),
+			Avaliable: atoi(vals[1]),
+		})
+	}
+	if len(expired) > 0 {
+		r.client.SRem(ctx, r.nodesKey(), expired...)
+	}
+	return res
+}
+
+// Borrow 在一个 lua 脚本里完成检查和转移，target 的容量不够时不借
+func (r *RedisRegistry) Borrow(addr, target string, cap int) bool {
+	if cap < 0 || addr == target {
+		return false
+	}
+	ok, err := borrowScript.Run(context.Background(), r.client,
+		[]string{r.nodeKey(addr), r.nodeKey(target)}, cap, r.ttl.Milliseconds()).Int()
+	return err == nil && ok == 1
+}
+
+// GetCap 节点不存在时返回 -1
+func (r *RedisRegistry) GetCap(addr string) int {
+	val, err := r.client.HGet(context.Background(), r.nodeKey(addr), fieldCap).Int()
+	if err != nil {
+		return -1
+	}
+	return val
+}
+
+// SetCap 同时为节点续期
+func (r *RedisRegistry) SetCap(addr string, cap int) bool {
+	ok, err := setCapScript.Run(context.Background(), r.client,
+		[]string{r.nodeKey(addr)}, cap, r.ttl.Milliseconds()).Int()
+	return err == nil && ok == 1
+}
+
+// Report 更新节点的可用量并续期，节点已经过期时返回 false
+func (r *RedisRegistry) Report(addr string, avaliable int) bool {
+	ok, err := reportScript.Run(context.Background(), r.client,
+		[]string{r.nodeKey(addr)}, avaliable, r.ttl.Milliseconds()).Int()
+	return err == nil && ok == 1
+}
+
+// KeepAlive 为节点续期，节点需要在 ttl 之内定时调用，节点已经过期时返回 false
+func (r *RedisRegistry) KeepAlive(addr string) bool {
+	ok, err := r.client.PExpire(context.Background(), r.nodeKey(addr), r.ttl).Result()
+	return err == nil && ok
+}
+
+func (r *RedisRegistry) nodesKey() string {
+	return "{" + r.prefix + "}:nodes"
+}
+
+func (r *RedisRegistry) nodeKey(addr string) string {
+	return "{" + r.prefix + "}:node:" + addr
+}
+
+func atoi(val interface{}) int {
+	s, _ := val.(string)
+	n, _ := strconv.Atoi(s)
+	return n
+}
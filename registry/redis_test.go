@@ -0,0 +1,91 @@
+package registry
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRedisRegistry(t *testing.T) (*RedisRegistry, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return NewRedisRegistry(client, RedisWithTTL(10*time.Second)), mr
+}
+
+func TestRedisRegistry(t *testing.T) {
+	r, _ := newTestRedisRegistry(t)
+	assert.True(t, r.Initial(NodeInfo{Addr: "app1", Cap: 100, Avaliable: 100}))
+	assert.True(t, r.Initial(NodeInfo{Addr: "app2", Cap: 100, Avaliable: 80}))
+
+	assert.Equal(t, 100, r.GetCap("app1"))
+	assert.Equal(t, -1, r.GetCap("app3"))
+	assert.ElementsMatch(t, []NodeInfo{
+		{Addr: "app1", Cap: 100, Avaliable: 100},
+		{Addr: "app2", Cap: 100, Avaliable: 80},
+	}, r.AllNodeInfo())
+
+	assert.True(t, r.Borrow("app1", "app2", 50))
+	assert.False(t, r.Borrow("app1", "app2", 51))
+	assert.False(t, r.Borrow("app1", "app3", 1))
+	assert.Equal(t, 150, r.GetCap("app1"))
+	assert.Equal(t, 50, r.GetCap("app2"))
+
+	assert.True(t, r.Report("app1", 20))
+	assert.False(t, r.Report("app3", 20))
+	assert.Equal(t, 150, r.GetCap("app1"))
+
+	assert.True(t, r.SetCap("app2", 70))
+	assert.False(t, r.SetCap("app3", 70))
+	assert.Equal(t, 70, r.GetCap("app2"))
+}
+
+func TestRedisRegistryBorrowAtomic(t *testing.T) {
+	r, _ := newTestRedisRegistry(t)
+	r.Initial(NodeInfo{Addr: "app1", Cap: 0})
+	r.Initial(NodeInfo{Addr: "app2", Cap: 50})
+
+	var borrowed int64
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if r.Borrow("app1", "app2", 1) {
+				atomic.AddInt64(&borrowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.EqualValues(t, 50, borrowed)
+	assert.Equal(t, 50, r.GetCap("app1"))
+	assert.Equal(t, 0, r.GetCap("app2"))
+}
+
+func TestRedisRegistryTTL(t *testing.T) {
+	r, mr := newTestRedisRegistry(t)
+	r.Initial(NodeInfo{Addr: "app1", Cap: 100})
+	r.Initial(NodeInfo{Addr: "app2", Cap: 100})
+
+	mr.FastForward(6 * time.Second)
+	assert.True(t, r.KeepAlive("app1"))
+	mr.FastForward(6 * time.Second)
+
+	// app2 没有续期
+	assert.Equal(t, -1, r.GetCap("app2"))
+	assert.False(t, r.KeepAlive("app2"))
+	assert.False(t, r.Borrow("app1", "app2", 1))
+	assert.Equal(t, []NodeInfo{{Addr: "app1", Cap: 100}}, r.AllNodeInfo())
+	members, _ := mr.Members("{ratelimit}:nodes")
+	assert.Equal(t, []string{"app1"}, members)
+
+	// 重新上线
+	assert.True(t, r.Initial(NodeInfo{Addr: "app2", Cap: 100}))
+	assert.Len(t, r.AllNodeInfo(), 2)
+}
@@ -14,3 +14,8 @@ type IRegistry interface {
 	GetCap(addr string) int                   // 获取容量更新自己节点的容量值
 	SetCap(addr string, cap int) bool
 }
+
+// IReporter 可选接口，只上报 Avaliable 并续期，不会覆盖其他节点借走的容量
+type IReporter interface {
+	Report(addr string, avaliable int) bool
+}
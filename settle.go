@@ -0,0 +1,249 @@
+package ratelimit
+
+// 处理完请求之后按实际的代价结算
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// Settler 可选接口，按实际的代价修正已经拿走的令牌
+type Settler interface {
+	Refund(n int64) // 还回 n 个令牌，不超过容量
+	Charge(n int64) // 额外扣掉 n 个令牌，不够时欠着，之后补充的令牌先用来还债
+}
+
+// Usage handler 处理完之后的信息
+type Usage struct {
+	Request   *http.Request
+	Status    int   // 响应的状态码
+	Bytes     int64 // 响应体的大小
+	Estimated int64 // 处理之前已经拿走的令牌数
+}
+
+// ActualCostFunc 计算请求实际的代价，和 Usage.Estimated 的差值会还回去或者补扣
+type ActualCostFunc func(u Usage) int64
+
+// MiddlewareWithActualCost 处理完请求之后按 actual 结算，
+// 只对实现了 Settler 的限流器(令牌桶、漏桶)和 DistributedMiddleware 生效
+//
+// DistributedMiddleware 只能把令牌还给实现了 Refunder 的后端，补扣时后端额度不够也不会欠债
+func MiddlewareWithActualCost(actual ActualCostFunc) MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.actualCost = actual
+	}
+}
+
+// NoChargeOnServerError 5xx 的响应不收费，其余按预估的代价
+func NoChargeOnServerError() ActualCostFunc {
+	return func(u Usage) int64 {
+		if u.Status >= http.StatusInternalServerError {
+			return 0
+		}
+		return u.Estimated
+	}
+}
+
+// ChargeByResponseBytes 每 bytesPerToken 字节的响应体消耗一个令牌，向上取整，最少消耗 1 个
+func ChargeByResponseBytes(bytesPerToken int64) ActualCostFunc {
+	if bytesPerToken <= 0 {
+		panic("ratelimit: bytes per token is not > 0")
+	}
+	return func(u Usage) int64 {
+		if u.Bytes <= bytesPerToken {
+			return 1
+		}
+		return (u.Bytes + bytesPerToken - 1) / bytesPerToken
+	}
+}
+
+// ChargeByReport 使用 handler 通过 ReportCost 上报的代价，没有上报时按预估的代价
+func ChargeByReport() ActualCostFunc {
+	return func(u Usage) int64 {
+		if cost, ok := reportedCost(u.Request.Context()); ok {
+			return cost
+		}
+		return u.Estimated
+	}
+}
+
+type costReportKey struct{}
+
+// costReport handler 上报的代价，-1 表示没有上报
+type costReport struct {
+	cost int64
+}
+
+// ReportCost handler 上报这次请求实际的代价，比如返回的行数，
+// 只有设置了 MiddlewareWithActualCost 的中间件后面才有效，返回 false 表示没有地方接收
+func ReportCost(ctx context.Context, cost int64) bool {
+	report, ok := ctx.Value(costReportKey{}).(*costReport)
+	if !ok {
+		return false
+	}
+	atomic.StoreInt64(&report.cost, cost)
+	return true
+}
+
+func reportedCost(ctx context.Context) (int64, bool) {
+	report, ok := ctx.Value(costReportKey{}).(*costReport)
+	if !ok {
+		return 0, false
+	}
+	cost := atomic.LoadInt64(&report.cost)
+	return cost, cost >= 0
+}
+
+// responseInfo gin.ResponseWriter 也实现了这个接口，不需要再包一层
+type responseInfo interface {
+	Status() int
+	Size() int
+}
+
+// usageWriter 记录响应的状态码和大小
+type usageWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *usageWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *usageWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
+}
+
+func (w *usageWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *usageWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *usageWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *usageWriter) Size() int {
+	return w.size
+}
+
+func (w *usageWriter) hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := w.ResponseWriter.(http.Hijacker).Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+func (w *usageWriter) push(target string, opts *http.PushOptions) error {
+	return w.ResponseWriter.(http.Pusher).Push(target, opts)
+}
+
+// 原来的 ResponseWriter 实现了哪些可选接口，包装之后也实现哪些，否则 websocket 之类的升级会失败
+type (
+	hijackUsageWriter struct{ *usageWriter }
+	pushUsageWriter   struct{ *usageWriter }
+	fullUsageWriter   struct{ *usageWriter }
+)
+
+func (w hijackUsageWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.hijack()
+}
+
+func (w pushUsageWriter) Push(target string, opts *http.PushOptions) error {
+	return w.push(target, opts)
+}
+
+func (w fullUsageWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.hijack()
+}
+
+func (w fullUsageWriter) Push(target string, opts *http.PushOptions) error {
+	return w.push(target, opts)
+}
+
+// trackUsage w 本身能拿到状态码和大小时直接使用，否则包一层 usageWriter
+func trackUsage(w http.ResponseWriter) (http.ResponseWriter, responseInfo) {
+	if info, ok := w.(responseInfo); ok {
+		return w, info
+	}
+	uw := &usageWriter{ResponseWriter: w}
+	_, hijacker := w.(http.Hijacker)
+	_, pusher := w.(http.Pusher)
+	switch {
+	case hijacker && pusher:
+		return fullUsageWriter{uw}, uw
+	case hijacker:
+		return hijackUsageWriter{uw}, uw
+	case pusher:
+		return pushUsageWriter{uw}, uw
+	}
+	return uw, uw
+}
+
+// serveAndSettle 执行 handler 并返回实际代价和预估代价的差值，没有设置 actualCost 时为 0
+func serveAndSettle(conf middlewareConfig, w http.ResponseWriter, r *http.Request, next http.Handler, estimated int64) int64 {
+	if conf.actualCost == nil {
+		next.ServeHTTP(w, r)
+		return 0
+	}
+	w, info := trackUsage(w)
+	r = r.WithContext(context.WithValue(r.Context(), costReportKey{}, &costReport{cost: -1}))
+	next.ServeHTTP(w, r)
+
+	size := int64(info.Size())
+	if size < 0 {
+		size = 0
+	}
+	actual := conf.actualCost(Usage{Request: r, Status: info.Status(), Bytes: size, Estimated: estimated})
+	if actual < 0 {
+		actual = 0
+	}
+	return actual - estimated
+}
+
+// settle 按差值还回或者补扣令牌
+func settle(l Limiter, diff int64) {
+	s, ok := l.(Settler)
+	if !ok {
+		return
+	}
+	if diff < 0 {
+		s.Refund(-diff)
+	} else if diff > 0 {
+		s.Charge(diff)
+	}
+}
+
+// settleDistributed 按差值还回或者补扣分布式限流器的令牌，出错时忽略
+// 请求可能已经被取消了，不使用请求的 context
+func settleDistributed(l DistributedLimiter, key string, diff int64) {
+	ctx := context.Background()
+	if diff < 0 {
+		if refunder, ok := l.(Refunder); ok {
+			_ = refunder.Refund(ctx, key, -diff)
+		}
+	} else if diff > 0 {
+		_, _ = l.Throttle(ctx, key, diff)
+	}
+}
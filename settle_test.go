@@ -0,0 +1,151 @@
+package ratelimit
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucketRefundCharge(t *testing.T) {
+	clk := clock.NewMock()
+	tb := NewBucket(time.Second, 10, BucketWithClock(clk))
+	tb.TakeAvailable(4)
+
+	tb.Refund(100)
+	assert.Equal(t, int64(10), tb.Available())
+
+	tb.Charge(15)
+	assert.Equal(t, int64(-5), tb.Available())
+	clk.Add(6 * time.Second)
+	assert.Equal(t, int64(1), tb.Available())
+}
+
+// newSettleHandler /fail 返回 500，/rows?n= 返回 n 字节并上报 n 的代价
+func newSettleHandler(mw func(http.Handler) http.Handler) http.Handler {
+	return mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/fail":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/rows":
+			n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+			ReportCost(r.Context(), int64(n))
+			_, _ = w.Write([]byte(strings.Repeat("x", n)))
+		}
+	}))
+}
+
+func TestNoChargeOnServerError(t *testing.T) {
+	h := newSettleHandler(TokenBucketMiddleware(time.Hour, 2, 1,
+		MiddlewareWithKeyFunc(KeyByHeader("X-User")), MiddlewareWithActualCost(NoChargeOnServerError())))
+	user := map[string]string{"X-User": "1"}
+
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusInternalServerError, doRequest(h, "/fail", user))
+	}
+	assert.Equal(t, http.StatusOK, doRequest(h, "/rows?n=1", user))
+	assert.Equal(t, http.StatusOK, doRequest(h, "/rows?n=1", user))
+	assert.Equal(t, http.StatusTooManyRequests, doRequest(h, "/rows?n=1", user))
+}
+
+func TestLeakyBucketSettle(t *testing.T) {
+	clk := clock.NewMock()
+	clk.Set(time.Now())
+	byUser := MiddlewareWithKeyFunc(KeyByHeader("X-User"))
+	h := newSettleHandler(LeakyBucketMiddleware(1, byUser, MiddlewareWithMaxWait(0), MiddlewareWithClock(clk),
+		MiddlewareWithActualCost(NoChargeOnServerError())))
+	user := map[string]string{"X-User": "1"}
+
+	// 5xx 的请求把时间片还回去了
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusInternalServerError, doRequest(h, "/fail", user))
+	}
+	assert.Equal(t, http.StatusOK, doRequest(h, "/rows?n=1", user))
+	assert.Equal(t, http.StatusTooManyRequests, doRequest(h, "/rows?n=1", user))
+
+	h = newSettleHandler(LeakyBucketMiddleware(1, byUser, MiddlewareWithMaxWait(time.Second), MiddlewareWithClock(clk),
+		MiddlewareWithActualCost(ChargeByReport())))
+	// 实际用了 3 个，下一个请求要等 3 秒
+	assert.Equal(t, http.StatusOK, doRequest(h, "/rows?n=3", user))
+	clk.Add(time.Second)
+	assert.Equal(t, http.StatusTooManyRequests, doRequest(h, "/rows?n=1", user))
+	clk.Add(2 * time.Second)
+	assert.Equal(t, http.StatusOK, doRequest(h, "/rows?n=1", user))
+}
+
+func TestChargeByResponseBytes(t *testing.T) {
+	h := newSettleHandler(TokenBucketMiddleware(time.Hour, 10, 1,
+		MiddlewareWithKeyFunc(KeyByHeader("X-User")), MiddlewareWithActualCost(ChargeByResponseBytes(100))))
+	user := map[string]string{"X-User": "1"}
+
+	// 欠了 2 个令牌，之后的请求都被拒绝
+	assert.Equal(t, http.StatusOK, doRequest(h, "/rows?n=1200", user))
+	assert.Equal(t, http.StatusTooManyRequests, doRequest(h, "/rows?n=1", user))
+}
+
+func TestChargeByReport(t *testing.T) {
+	h := newSettleHandler(TokenBucketMiddleware(time.Hour, 10, 1,
+		MiddlewareWithKeyFunc(KeyByHeader("X-User")), MiddlewareWithCost(CostByContext(5)),
+		MiddlewareWithActualCost(ChargeByReport())))
+	user := map[string]string{"X-User": "1"}
+
+	// 预留 5 个，实际只用了 1 个
+	assert.Equal(t, http.StatusOK, doRequest(h, "/rows?n=1", user))
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/fail", nil)
+	r.Header.Set("X-User", "1")
+	h.ServeHTTP(w, r)
+	assert.Equal(t, "4", w.Header().Get(HeaderXRateLimitRemaining))
+	// 没有上报时按预估的代价
+	assert.Equal(t, http.StatusTooManyRequests, doRequest(h, "/rows?n=1", user))
+}
+
+func TestDistributedSettle(t *testing.T) {
+	limiter := &testDistributed{store: gcraStore{rate: 1, burst: 4, per: time.Hour, data: NewMemoryStore()}}
+	h := newSettleHandler(DistributedMiddleware(limiter,
+		MiddlewareWithKeyFunc(KeyByHeader("X-User")), MiddlewareWithActualCost(ChargeByReport())))
+	user := map[string]string{"X-User": "1"}
+
+	// 补扣 4 个令牌，额度用完了
+	assert.Equal(t, http.StatusOK, doRequest(h, "/rows?n=5", user))
+	assert.Equal(t, http.StatusTooManyRequests, doRequest(h, "/rows?n=1", user))
+}
+
+// hijackRecorder 支持 Hijack 的 ResponseWriter
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (w *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return nil, nil, nil
+}
+
+func TestSettleKeepsHijacker(t *testing.T) {
+	var usage Usage
+	h := TokenBucketMiddleware(time.Hour, 10, 1, MiddlewareWithActualCost(func(u Usage) int64 {
+		usage = u
+		return u.Estimated
+	}))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hijacker, ok := w.(http.Hijacker)
+		if !assert.True(t, ok) {
+			return
+		}
+		_, _, _ = hijacker.Hijack()
+		_, ok = w.(http.Pusher)
+		assert.False(t, ok)
+	}))
+
+	w := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ws", nil))
+	assert.True(t, w.hijacked)
+	assert.Equal(t, http.StatusSwitchingProtocols, usage.Status)
+}
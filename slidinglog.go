@@ -0,0 +1,240 @@
+package ratelimit
+
+// 滑动窗口日志实现
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type slidingLog struct {
+	limit  int64
+	window time.Duration
+	clock  Clock // 为 nil 时使用真实的时间
+
+	data Store
+}
+
+// if not exist, create
+func (m *slidingLog) GetLog(key string) *SlidingLog {
+	return m.data.LoadOrStore(key, func() interface{} {
+		return NewSlidingLog(m.limit, m.window, WindowWithClock(m.clock))
+	}).(*SlidingLog)
+}
+
+// SlidingLog 滑动窗口日志，任意 window 长度的时间段内最多通过 limit 个请求
+// 用长度为 limit 的环形缓冲按时间顺序记录最近的请求时间，内存占用和 limit 成正比
+type SlidingLog struct {
+	clock Clock
+
+	limit  int64
+	window time.Duration
+
+	mu    sync.Mutex
+	times []int64 // unix nanoseconds，环形缓冲
+	head  int     // 最早一条记录的位置
+	size  int
+	seq   int64 // 每次写入记录加一，用来判断预留之后有没有新的记录
+}
+
+func NewSlidingLog(limit int64, window time.Duration, opts ...windowOpt) *SlidingLog {
+	if limit <= 0 {
+		panic("sliding log limit is not > 0")
+	}
+	if window <= 0 {
+		panic("sliding log window is not > 0")
+	}
+	return &SlidingLog{
+		clock:  newWindowConfig(opts...).clock,
+		limit:  limit,
+		window: window,
+		times:  make([]int64, limit),
+	}
+}
+
+func (l *SlidingLog) Allow() bool {
+	return l.AllowN(1)
+}
+
+func (l *SlidingLog) AllowN(n int64) bool {
+	return l.reserveN(n, 0).ok
+}
+
+func (l *SlidingLog) Reserve() *Reservation {
+	return l.ReserveN(1)
+}
+
+func (l *SlidingLog) ReserveN(n int64) *Reservation {
+	return l.reserveN(n, infinityDuration)
+}
+
+func (l *SlidingLog) ReserveMaxDuration(n int64, maxWait time.Duration) *Reservation {
+	return l.reserveN(n, maxWait)
+}
+
+func (l *SlidingLog) Wait() error {
+	return l.WaitN(1)
+}
+
+func (l *SlidingLog) WaitN(n int64) error {
+	rv := l.ReserveN(n)
+	if !rv.OK() {
+		return ErrExceedsLimit
+	}
+	if d := rv.Delay(); d > 0 {
+		l.clock.Sleep(d)
+	}
+	return nil
+}
+
+func (l *SlidingLog) WaitContext(ctx context.Context, n int64) error {
+	maxWait, err := waitBudget(ctx, l.clock)
+	if err != nil {
+		return err
+	}
+	return l.reserveN(n, maxWait).Wait(ctx)
+}
+
+// Available 最近一个窗口内还能通过多少请求
+func (l *SlidingLog) Available() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.available(l.clock.Now())
+}
+
+// Throttle 尝试拿 n 个许可，ResetAfter 为最新的记录滑出窗口的时间
+func (l *SlidingLog) Throttle(n int64) Result {
+	r := l.reserveN(n, 0)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock.Now()
+	res := Result{
+		Allowed:    r.ok,
+		Limit:      l.limit,
+		Remaining:  l.available(now),
+		RetryAfter: -1,
+	}
+	if !r.ok && n <= l.limit {
+		t, _ := l.earliest(now, n)
+		res.RetryAfter = time.Unix(0, t).Sub(now)
+	}
+	if l.size > 0 {
+		if d := time.Unix(0, l.at(l.size-1)).Add(l.window).Sub(now); d > 0 {
+			res.ResetAfter = d
+		}
+	}
+	return res
+}
+
+func (l *SlidingLog) available(now time.Time) int64 {
+	used := int64(0)
+	for i := l.size - 1; i >= 0 && l.at(i) > now.UnixNano()-int64(l.window); i-- {
+		used++
+	}
+	if used >= l.limit {
+		return 0
+	}
+	return l.limit - used
+}
+
+// Idle 所有记录都已经滑出窗口
+func (l *SlidingLog) Idle() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.size == 0 || l.at(l.size-1) <= l.clock.Now().UnixNano()-int64(l.window)
+}
+
+func (l *SlidingLog) reserveN(n int64, maxWait time.Duration) *Reservation {
+	now := l.clock.Now()
+	r := &Reservation{clock: l.clock}
+	if n <= 0 {
+		r.ok = true
+		r.timeToAct = now
+		return r
+	}
+	if n > l.limit {
+		return r
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t, evict := l.earliest(now, n)
+	timeToAct := time.Unix(0, t)
+	if timeToAct.Sub(now) > maxWait {
+		r.timeToAct = timeToAct
+		return r
+	}
+
+	var evicted []int64
+	if evict > 0 {
+		evicted = make([]int64, evict)
+		for i := range evicted {
+			evicted[i] = l.popFront()
+		}
+	}
+	for i := int64(0); i < n; i++ {
+		l.pushBack(t)
+	}
+	l.seq++
+	seq := l.seq
+	r.ok = true
+	r.timeToAct = timeToAct
+	r.cancel = func() { l.cancel(n, t, seq, evicted) }
+	return r
+}
+
+// earliest 最早什么时候能放入 n 条记录，以及需要挤掉多少条旧记录
+func (l *SlidingLog) earliest(now time.Time, n int64) (int64, int) {
+	t := now.UnixNano()
+	// 保持记录有序，排在已有的预留之后
+	if l.size > 0 && l.at(l.size-1) > t {
+		t = l.at(l.size - 1)
+	}
+	// 放入 n 条记录要挤掉最早的几条，被挤掉的必须已经滑出窗口
+	evict := l.size + int(n) - int(l.limit)
+	if evict > 0 {
+		if e := l.at(evict-1) + int64(l.window); e > t {
+			t = e
+		}
+	}
+	return t, evict
+}
+
+// cancel 只有这次预留还是最新的记录时才能撤销，把挤掉的记录放回去
+// 之后又有新的记录时，撤销会打乱顺序，直接放弃
+func (l *SlidingLog) cancel(n, t, seq int64, evicted []int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if t <= l.clock.Now().UnixNano() || seq != l.seq {
+		return
+	}
+	l.size -= int(n)
+	l.seq++
+	for i := len(evicted) - 1; i >= 0; i-- {
+		l.pushFront(evicted[i])
+	}
+}
+
+func (l *SlidingLog) at(i int) int64 {
+	return l.times[(l.head+i)%len(l.times)]
+}
+
+func (l *SlidingLog) popFront() int64 {
+	t := l.times[l.head]
+	l.head = (l.head + 1) % len(l.times)
+	l.size--
+	return t
+}
+
+func (l *SlidingLog) pushFront(t int64) {
+	l.head = (l.head - 1 + len(l.times)) % len(l.times)
+	l.times[l.head] = t
+	l.size++
+}
+
+func (l *SlidingLog) pushBack(t int64) {
+	l.times[(l.head+l.size)%len(l.times)] = t
+	l.size++
+}
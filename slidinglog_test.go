@@ -0,0 +1,57 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSlidingLog(limit int64, window time.Duration) (*SlidingLog, *clock.Mock) {
+	clk := clock.NewMock()
+	clk.Set(time.Now())
+	return NewSlidingLog(limit, window, WindowWithClock(clk)), clk
+}
+
+func TestSlidingLogExact(t *testing.T) {
+	l, clk := newTestSlidingLog(3, time.Minute)
+
+	assert.True(t, l.AllowN(2))
+	clk.Add(30 * time.Second)
+	assert.True(t, l.Allow())
+	assert.False(t, l.Allow())
+
+	// the first two slid out, the third is still in the window
+	clk.Add(30 * time.Second)
+	assert.Equal(t, int64(2), l.Available())
+	assert.True(t, l.AllowN(2))
+	assert.False(t, l.Allow())
+
+	clk.Add(30 * time.Second)
+	assert.True(t, l.Allow())
+	assert.False(t, l.Allow())
+}
+
+func TestSlidingLogReserve(t *testing.T) {
+	l, clk := newTestSlidingLog(2, time.Minute)
+
+	assert.True(t, l.Allow())
+	clk.Add(10 * time.Second)
+	assert.True(t, l.Allow())
+
+	r1 := l.Reserve()
+	assert.True(t, r1.OK())
+	assert.Equal(t, 50*time.Second, r1.Delay())
+
+	r2 := l.Reserve()
+	assert.True(t, r2.OK())
+	assert.Equal(t, time.Minute, r2.Delay())
+	assert.False(t, l.ReserveN(3).OK())
+
+	// r1 is no longer the newest, it can't be given back
+	r1.Cancel()
+	r2.Cancel()
+	r3 := l.Reserve()
+	assert.Equal(t, time.Minute, r3.Delay())
+}
@@ -0,0 +1,260 @@
+package ratelimit
+
+// 滑动窗口计数器实现
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+type slidingWindow struct {
+	limit  int64
+	window time.Duration
+	clock  Clock // 为 nil 时使用真实的时间
+
+	data Store
+}
+
+// if not exist, create
+func (m *slidingWindow) GetWindow(key string) *SlidingWindow {
+	return m.data.LoadOrStore(key, func() interface{} {
+		return NewSlidingWindow(m.limit, m.window, WindowWithClock(m.clock))
+	}).(*SlidingWindow)
+}
+
+// SlidingWindow 滑动窗口计数器，只保存相邻两个窗口的计数
+// 用上一个窗口的计数按还没滑出去的比例加权，估算最近一个窗口长度内的请求数：
+//
+//	estimate = prev * (1 - elapsed/window) + curr
+//
+// 假设上一个窗口内的请求是均匀分布的，所以结果是近似的，需要精确限制请使用 SlidingLog
+type SlidingWindow struct {
+	clock Clock
+
+	limit  int64
+	window time.Duration
+
+	mu     sync.Mutex
+	start  int64   // counts[0] 对应的窗口序号
+	counts []int64 // counts[0] 上一个窗口，counts[1] 当前窗口，之后是预留到未来窗口的计数
+}
+
+func NewSlidingWindow(limit int64, window time.Duration, opts ...windowOpt) *SlidingWindow {
+	if limit <= 0 {
+		panic("sliding window limit is not > 0")
+	}
+	if window <= 0 {
+		panic("sliding window length is not > 0")
+	}
+	w := &SlidingWindow{
+		clock:  newWindowConfig(opts...).clock,
+		limit:  limit,
+		window: window,
+		counts: make([]int64, 2),
+	}
+	w.start = w.windowIndex(w.clock.Now()) - 1
+	return w
+}
+
+func (w *SlidingWindow) Allow() bool {
+	return w.AllowN(1)
+}
+
+func (w *SlidingWindow) AllowN(n int64) bool {
+	return w.reserveN(n, 0).ok
+}
+
+func (w *SlidingWindow) Reserve() *Reservation {
+	return w.ReserveN(1)
+}
+
+func (w *SlidingWindow) ReserveN(n int64) *Reservation {
+	return w.reserveN(n, infinityDuration)
+}
+
+func (w *SlidingWindow) ReserveMaxDuration(n int64, maxWait time.Duration) *Reservation {
+	return w.reserveN(n, maxWait)
+}
+
+func (w *SlidingWindow) Wait() error {
+	return w.WaitN(1)
+}
+
+func (w *SlidingWindow) WaitN(n int64) error {
+	rv := w.ReserveN(n)
+	if !rv.OK() {
+		return ErrExceedsLimit
+	}
+	if d := rv.Delay(); d > 0 {
+		w.clock.Sleep(d)
+	}
+	return nil
+}
+
+func (w *SlidingWindow) WaitContext(ctx context.Context, n int64) error {
+	maxWait, err := waitBudget(ctx, w.clock)
+	if err != nil {
+		return err
+	}
+	return w.reserveN(n, maxWait).Wait(ctx)
+}
+
+// Available 按估算值还能通过多少请求
+func (w *SlidingWindow) Available() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := w.clock.Now()
+	w.advance(w.windowIndex(now))
+	return w.available(now)
+}
+
+// Throttle 尝试拿 n 个许可，ResetAfter 为所有计数都滑出窗口的时间
+func (w *SlidingWindow) Throttle(n int64) Result {
+	r := w.reserveN(n, 0)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := w.clock.Now()
+	w.advance(w.windowIndex(now))
+	res := Result{
+		Allowed:    r.ok,
+		Limit:      w.limit,
+		Remaining:  w.available(now),
+		RetryAfter: -1,
+	}
+	if !r.ok && n <= w.limit {
+		_, timeToAct := w.earliest(now, n)
+		res.RetryAfter = timeToAct.Sub(now)
+	}
+	// 最后一个有计数的窗口之后再过一个窗口才会完全滑出去
+	for k := len(w.counts) - 1; k >= 0; k-- {
+		if w.counts[k] > 0 {
+			res.ResetAfter = time.Unix(0, (w.start+int64(k)+2)*int64(w.window)).Sub(now)
+			break
+		}
+	}
+	return res
+}
+
+func (w *SlidingWindow) available(now time.Time) int64 {
+	elapsed := float64(now.UnixNano()%int64(w.window)) / float64(w.window)
+	estimate := float64(w.counts[0])*(1-elapsed) + float64(w.counts[1])
+	if avail := w.limit - int64(math.Ceil(estimate)); avail > 0 {
+		return avail
+	}
+	return 0
+}
+
+// Idle 两个窗口的计数都已经清零
+func (w *SlidingWindow) Idle() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.advance(w.windowIndex(w.clock.Now()))
+	for _, c := range w.counts {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (w *SlidingWindow) reserveN(n int64, maxWait time.Duration) *Reservation {
+	now := w.clock.Now()
+	r := &Reservation{clock: w.clock}
+	if n <= 0 {
+		r.ok = true
+		r.timeToAct = now
+		return r
+	}
+	if n > w.limit {
+		return r
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.advance(w.windowIndex(now))
+	k, timeToAct := w.earliest(now, n)
+	if timeToAct.Sub(now) > maxWait {
+		r.timeToAct = timeToAct
+		return r
+	}
+
+	for len(w.counts) <= k {
+		w.counts = append(w.counts, 0)
+	}
+	w.counts[k] += n
+	win := w.start + int64(k)
+	r.ok = true
+	r.timeToAct = timeToAct
+	r.cancel = func() { w.cancel(win, n, timeToAct) }
+	return r
+}
+
+// earliest 从当前窗口开始找第一个放得下 n 个请求的时间点，k 为所在窗口在 counts 中的位置
+func (w *SlidingWindow) earliest(now time.Time, n int64) (int, time.Time) {
+	for k := 1; ; k++ {
+		prev, curr := w.count(k-1), w.count(k)
+		if curr+n > w.limit {
+			continue
+		}
+		timeToAct := time.Unix(0, (w.start+int64(k))*int64(w.window))
+		if prev > 0 {
+			// 上一个窗口的权重降到多少才放得下
+			if f := 1 - float64(w.limit-curr-n)/float64(prev); f > 0 {
+				timeToAct = timeToAct.Add(time.Duration(math.Ceil(f * float64(w.window))))
+			}
+		}
+		if timeToAct.Before(now) {
+			timeToAct = now
+		}
+		return k, timeToAct
+	}
+}
+
+func (w *SlidingWindow) cancel(win, n int64, timeToAct time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := w.clock.Now()
+	if !timeToAct.After(now) {
+		return
+	}
+	w.advance(w.windowIndex(now))
+	k := win - w.start
+	if k < 1 || k >= int64(len(w.counts)) {
+		return
+	}
+	w.counts[k] -= n
+	if w.counts[k] < 0 {
+		w.counts[k] = 0
+	}
+}
+
+func (w *SlidingWindow) count(k int) int64 {
+	if k < len(w.counts) {
+		return w.counts[k]
+	}
+	return 0
+}
+
+func (w *SlidingWindow) windowIndex(now time.Time) int64 {
+	return now.UnixNano() / int64(w.window)
+}
+
+// advance 让 idx 成为当前窗口
+func (w *SlidingWindow) advance(idx int64) {
+	shift := idx - 1 - w.start
+	if shift <= 0 {
+		return
+	}
+	if shift >= int64(len(w.counts)) {
+		w.counts = w.counts[:0]
+	} else {
+		w.counts = append(w.counts[:0], w.counts[shift:]...)
+	}
+	for len(w.counts) < 2 {
+		w.counts = append(w.counts, 0)
+	}
+	w.start = idx - 1
+}
@@ -0,0 +1,51 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSlidingWindow(limit int64, window time.Duration) (*SlidingWindow, *clock.Mock) {
+	clk := clock.NewMock()
+	clk.Set(time.Unix(0, 0).Add(1000 * window))
+	return NewSlidingWindow(limit, window, WindowWithClock(clk)), clk
+}
+
+func TestSlidingWindowWeighted(t *testing.T) {
+	w, clk := newTestSlidingWindow(10, time.Minute)
+
+	assert.True(t, w.AllowN(10))
+	assert.False(t, w.Allow())
+
+	// previous window weighs 3/4: 10*0.75 = 7.5
+	clk.Add(time.Minute + 15*time.Second)
+	assert.Equal(t, int64(2), w.Available())
+	assert.True(t, w.AllowN(2))
+	assert.False(t, w.Allow())
+
+	// previous window weighs 1/4: 10*0.25 + 2 = 4.5
+	clk.Add(30 * time.Second)
+	assert.Equal(t, int64(5), w.Available())
+
+	// both windows slid out
+	clk.Add(2 * time.Minute)
+	assert.Equal(t, int64(10), w.Available())
+}
+
+func TestSlidingWindowReserve(t *testing.T) {
+	w, clk := newTestSlidingWindow(10, time.Minute)
+
+	assert.True(t, w.AllowN(10))
+	// needs the previous window to weigh no more than 0.5
+	r := w.ReserveN(5)
+	assert.True(t, r.OK())
+	assert.Equal(t, time.Minute+30*time.Second, r.Delay())
+	assert.False(t, w.ReserveN(11).OK())
+
+	r.Cancel()
+	clk.Add(time.Minute + 30*time.Second)
+	assert.Equal(t, int64(5), w.Available())
+}
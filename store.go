@@ -0,0 +1,253 @@
+package ratelimit
+
+// 按 key 保存限流器
+
+import (
+	"container/list"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Store 按 key 保存限流器，值的类型由使用方决定
+type Store interface {
+	// LoadOrStore 返回 key 对应的值，不存在时调用 create 创建并保存
+	LoadOrStore(key string, create func() interface{}) interface{}
+	Delete(key string)
+	Len() int
+}
+
+// Idler 限流器回到了刚创建时的状态(比如令牌桶已经满了)，丢掉之后再重新创建不会有任何区别
+// MemoryStore 只会淘汰 Idle 的 Idler，否则重新创建的限流器等于把额度重置了
+type Idler interface {
+	Idle() bool
+}
+
+// MemoryStore 内存中的 Store，超过 maxEntries 时淘汰最久没有用过的 key，
+// 空闲超过 ttl 的 key 以及处于初始状态的限流器由后台协程定期清理。
+// 实现了 Idler 的值不在初始状态时以及刚访问过的 key 不会被淘汰，全都在用时允许暂时超过 maxEntries
+type MemoryStore struct {
+	clock      Clock
+	ttl        time.Duration // 空闲多久之后清理，0 表示不按时间清理
+	maxEntries int           // 最多保存多少个 key，0 表示不限制
+	interval   time.Duration // 后台清理的间隔，0 表示不启动后台清理
+	inline     bool          // 不启动后台协程，在 LoadOrStore 里每隔 interval 顺带清理
+
+	mu          sync.Mutex
+	ll          *list.List // 最近用过的在前面
+	items       map[string]*list.Element
+	lastCleanup time.Time
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+type storeEntry struct {
+	key        string
+	value      interface{}
+	lastAccess time.Time
+}
+
+type storeOpt func(s *MemoryStore)
+
+func StoreWithClock(clock Clock) storeOpt {
+	return func(s *MemoryStore) {
+		if clock == nil {
+			clock = realClock{}
+		}
+		s.clock = clock
+	}
+}
+
+func StoreWithTTL(ttl time.Duration) storeOpt {
+	return func(s *MemoryStore) {
+		s.ttl = ttl
+	}
+}
+
+func StoreWithMaxEntries(maxEntries int) storeOpt {
+	return func(s *MemoryStore) {
+		s.maxEntries = maxEntries
+	}
+}
+
+func StoreWithCleanupInterval(interval time.Duration) storeOpt {
+	return func(s *MemoryStore) {
+		s.interval = interval
+	}
+}
+
+// StoreWithInlineCleanup 不启动后台协程，在 LoadOrStore 时每隔一个清理间隔顺带清理一次，
+// 用完之后不需要 Close
+func StoreWithInlineCleanup() storeOpt {
+	return func(s *MemoryStore) {
+		s.inline = true
+	}
+}
+
+// NewMemoryStore 默认最多保存 10000 个 key，空闲 10 分钟清理，每分钟检查一次
+func NewMemoryStore(opts ...storeOpt) *MemoryStore {
+	s := &MemoryStore{
+		clock:      realClock{},
+		ttl:        10 * time.Minute,
+		maxEntries: 10000,
+		interval:   time.Minute,
+		ll:         list.New(),
+		items:      map[string]*list.Element{},
+		stop:       make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.lastCleanup = s.clock.Now()
+	if s.interval > 0 && !s.inline {
+		go s.janitor()
+	}
+	return s
+}
+
+// storeNamespaces 已经分出去的命名空间个数
+var storeNamespaces int64
+
+// namespacedStore 多个中间件共用一个 Store 时，每个中间件的 key 加上各自的前缀，
+// 否则同一个 key 会取到别的中间件创建的限流器，类型断言直接 panic
+type namespacedStore struct {
+	Store
+	prefix string
+}
+
+func (s namespacedStore) LoadOrStore(key string, create func() interface{}) interface{} {
+	return s.Store.LoadOrStore(s.prefix+key, create)
+}
+
+func (s namespacedStore) Delete(key string) {
+	s.Store.Delete(s.prefix + key)
+}
+
+// defaultStore store 为 nil 时创建一个不需要 Close 的 MemoryStore，否则分出一个独立的命名空间
+func defaultStore(store Store, clock Clock) Store {
+	if store != nil {
+		prefix := strconv.FormatInt(atomic.AddInt64(&storeNamespaces, 1), 10) + ":"
+		return namespacedStore{Store: store, prefix: prefix}
+	}
+	if clock == nil {
+		clock = realClock{}
+	}
+	return NewMemoryStore(StoreWithClock(clock), StoreWithInlineCleanup())
+}
+
+func (s *MemoryStore) LoadOrStore(key string, create func() interface{}) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.clock.Now()
+	if s.inline && s.interval > 0 && now.Sub(s.lastCleanup) >= s.interval {
+		s.cleanup(now)
+	}
+	if e, ok := s.items[key]; ok {
+		entry := e.Value.(*storeEntry)
+		entry.lastAccess = now
+		s.ll.MoveToFront(e)
+		return entry.value
+	}
+
+	entry := &storeEntry{key: key, value: create(), lastAccess: now}
+	s.items[key] = s.ll.PushFront(entry)
+	if s.maxEntries > 0 && s.ll.Len() > s.maxEntries {
+		s.evict(now, s.ll.Len()-s.maxEntries)
+	}
+	return entry.value
+}
+
+// evictGrace 刚取出去的限流器调用方可能还没来得及用，看起来是 Idle 的，
+// 这时淘汰掉的话调用方用的是旧的，下一个请求拿到新建的，等于多放行了一次
+const evictGrace = time.Second
+
+// evict 从最久没有用过的开始淘汰 n 个可以丢掉的 key，跳过 evictGrace 内访问过的
+func (s *MemoryStore) evict(now time.Time, n int) {
+	for e := s.ll.Back(); e != nil && n > 0; {
+		prev := e.Prev()
+		entry := e.Value.(*storeEntry)
+		if now.Sub(entry.lastAccess) < evictGrace {
+			// 越往前访问得越晚
+			break
+		}
+		if idle(entry.value) {
+			s.removeElement(e)
+			n--
+		}
+		e = prev
+	}
+}
+
+// idle 丢掉之后重新创建不会有区别，没有实现 Idler 的值总是可以丢掉
+func idle(value interface{}) bool {
+	idler, ok := value.(Idler)
+	return !ok || idler.Idle()
+}
+
+func (s *MemoryStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.items[key]; ok {
+		s.removeElement(e)
+	}
+}
+
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ll.Len()
+}
+
+// Cleanup 清理空闲超过 ttl 的 key，以及一个清理间隔内没有用过并且处于初始状态的限流器，
+// 没有回到初始状态的限流器即使超过了 ttl 也不清理
+func (s *MemoryStore) Cleanup() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanup(s.clock.Now())
+}
+
+// cleanup 调用前需要持有锁
+func (s *MemoryStore) cleanup(now time.Time) {
+	s.lastCleanup = now
+	for e := s.ll.Back(); e != nil; {
+		prev := e.Prev()
+		entry := e.Value.(*storeEntry)
+		unused := now.Sub(entry.lastAccess)
+		expired := s.ttl > 0 && unused >= s.ttl
+		if _, ok := entry.value.(Idler); ok {
+			// 刚刚被取走的限流器可能还在用，留到下一轮
+			expired = expired || unused >= s.interval
+		}
+		if expired && idle(entry.value) {
+			s.removeElement(e)
+		}
+		e = prev
+	}
+}
+
+// Close 停止后台清理，没有启动后台清理时什么都不做
+func (s *MemoryStore) Close() {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+	})
+}
+
+func (s *MemoryStore) janitor() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Cleanup()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *MemoryStore) removeElement(e *list.Element) {
+	s.ll.Remove(e)
+	delete(s.items, e.Value.(*storeEntry).key)
+}
@@ -0,0 +1,126 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestStore(opts ...storeOpt) (*MemoryStore, *clock.Mock) {
+	clk := clock.NewMock()
+	clk.Set(time.Now())
+	opts = append([]storeOpt{StoreWithClock(clk), StoreWithCleanupInterval(0)}, opts...)
+	return NewMemoryStore(opts...), clk
+}
+
+func TestMemoryStoreLRU(t *testing.T) {
+	s, clk := newTestStore(StoreWithMaxEntries(2))
+	create := func(v int) func() interface{} {
+		return func() interface{} { return v }
+	}
+
+	assert.Equal(t, 1, s.LoadOrStore("a", create(1)))
+	assert.Equal(t, 2, s.LoadOrStore("b", create(2)))
+	clk.Add(time.Second)
+	assert.Equal(t, 1, s.LoadOrStore("a", create(10)))
+
+	// b is the least recently used one
+	clk.Add(time.Second)
+	assert.Equal(t, 3, s.LoadOrStore("c", create(3)))
+	assert.Equal(t, 2, s.Len())
+	assert.Equal(t, 1, s.LoadOrStore("a", create(10)))
+	clk.Add(time.Second)
+	assert.Equal(t, 20, s.LoadOrStore("b", create(20)))
+
+	s.Delete("b")
+	assert.Equal(t, 1, s.Len())
+}
+
+func TestMemoryStoreTTL(t *testing.T) {
+	s, clk := newTestStore(StoreWithTTL(time.Minute))
+	s.LoadOrStore("a", func() interface{} { return 1 })
+	clk.Add(30 * time.Second)
+	s.LoadOrStore("b", func() interface{} { return 2 })
+
+	clk.Add(30 * time.Second)
+	s.Cleanup()
+	assert.Equal(t, 1, s.Len())
+	assert.Equal(t, 2, s.LoadOrStore("b", func() interface{} { return 20 }))
+}
+
+func TestMemoryStoreIdle(t *testing.T) {
+	s, clk := newTestStore(StoreWithTTL(0))
+	bucket := &tokenBucket{fillInterval: time.Second, cap: 2, quantum: 1, data: s}
+
+	full := s.LoadOrStore("full", func() interface{} {
+		return NewBucket(time.Second, 2, BucketWithClock(clk))
+	}).(*Bucket)
+	used := s.LoadOrStore("used", func() interface{} {
+		return NewBucket(time.Second, 2, BucketWithClock(clk))
+	}).(*Bucket)
+	assert.True(t, used.Allow())
+	assert.True(t, full.Idle())
+	assert.False(t, used.Idle())
+
+	s.Cleanup()
+	assert.Equal(t, 1, s.Len())
+	assert.Same(t, used, bucket.GetBucket("used"))
+
+	// refilled
+	clk.Add(time.Second)
+	s.Cleanup()
+	assert.Equal(t, 0, s.Len())
+}
+
+func TestMemoryStoreKeepsBusyLimiters(t *testing.T) {
+	s, clk := newTestStore(StoreWithTTL(10*time.Minute), StoreWithMaxEntries(2))
+	window := s.LoadOrStore("window", func() interface{} {
+		return NewFixedWindow(1, 24*time.Hour, WindowWithClock(clk))
+	}).(*FixedWindow)
+	assert.True(t, window.Allow())
+
+	// 空闲超过了 ttl，但是窗口还没结束，丢掉的话额度就被重置了
+	clk.Add(time.Hour)
+	s.Cleanup()
+	assert.Same(t, window, s.LoadOrStore("window", func() interface{} { return nil }))
+
+	// 淘汰时跳过还在用的限流器
+	clk.Add(time.Second)
+	s.LoadOrStore("a", func() interface{} { return 1 })
+	clk.Add(time.Second)
+	s.LoadOrStore("b", func() interface{} { return 2 })
+	assert.Equal(t, 2, s.Len())
+	assert.Same(t, window, s.LoadOrStore("window", func() interface{} { return nil }))
+	assert.Equal(t, 20, s.LoadOrStore("a", func() interface{} { return 20 }))
+}
+
+func TestMemoryStoreKeepsJustFetched(t *testing.T) {
+	s, clk := newTestStore(StoreWithMaxEntries(1))
+	bucket := s.LoadOrStore("a", func() interface{} {
+		return NewBucket(time.Hour, 1, BucketWithClock(clk))
+	}).(*Bucket)
+
+	// a 刚取出去还没用，仍然是 Idle 的，不能被 b 挤掉
+	s.LoadOrStore("b", func() interface{} { return 2 })
+	assert.True(t, bucket.Allow())
+	assert.Same(t, bucket, s.LoadOrStore("a", func() interface{} { return nil }))
+	assert.Equal(t, 2, s.Len())
+}
+
+func TestMemoryStoreInlineCleanup(t *testing.T) {
+	clk := clock.NewMock()
+	clk.Set(time.Now())
+	s := NewMemoryStore(StoreWithClock(clk), StoreWithTTL(time.Minute), StoreWithInlineCleanup())
+	s.LoadOrStore("a", func() interface{} { return 1 })
+
+	clk.Add(30 * time.Second)
+	s.LoadOrStore("b", func() interface{} { return 2 })
+	assert.Equal(t, 2, s.Len())
+
+	// 过了一个清理间隔，下一次访问时顺带清理掉过期的 a
+	clk.Add(30 * time.Second)
+	s.LoadOrStore("b", func() interface{} { return 20 })
+	assert.Equal(t, 1, s.Len())
+}
@@ -2,6 +2,7 @@ package ratelimit
 
 // 令牌桶实现
 import (
+	"context"
 	"math"
 	"sync"
 	"time"
@@ -12,17 +13,16 @@ type tokenBucket struct {
 	fillInterval time.Duration
 	cap          int64
 	quantum      int64
+	clock        Clock // 为 nil 时使用真实的时间
 
-	data sync.Map
+	data Store
 }
 
 // if not exist, create
 func (m *tokenBucket) GetBucket(key string) *Bucket {
-	val, _ := m.data.LoadOrStore(key, func() *Bucket {
-		bucket := newBucket(m.fillInterval, m.cap, BucketWithQuantum(m.quantum))
-		return bucket
-	}())
-	return val.(*Bucket)
+	return m.data.LoadOrStore(key, func() interface{} {
+		return NewBucket(m.fillInterval, m.cap, BucketWithQuantum(m.quantum), BucketWithClock(m.clock))
+	}).(*Bucket)
 }
 
 type Bucket struct {
@@ -43,6 +43,8 @@ type Bucket struct {
 	availableTokens int64
 
 	latestTick int64
+
+	lastEvent time.Time // the latest time a reserved token can be used
 }
 
 type bucketOpt func(b *Bucket)
@@ -74,7 +76,9 @@ func BucketWithQuantum(quantum int64) bucketOpt {
 
 const rateMargin = 0.01
 
-func newBucket(fillInterval time.Duration, capacity int64, opts ...bucketOpt) *Bucket {
+// NewBucket 每 fillInterval 放入 quantum 个令牌，最多存 capacity 个
+// 使用 BucketWithRate 时会按每秒 rate 个重新计算放入的间隔
+func NewBucket(fillInterval time.Duration, capacity int64, opts ...bucketOpt) *Bucket {
 	if fillInterval <= 0 {
 		panic("token bucket fill interval is not > 0")
 	}
@@ -96,19 +100,27 @@ func newBucket(fillInterval time.Duration, capacity int64, opts ...bucketOpt) *B
 		opt(buck)
 	}
 
+	if buck.rate > 0 {
+		buck.setRate(buck.rate)
+	}
+	return buck
+}
+
+// setRate 找一组 quantum 和 fillInterval，使每秒放入的令牌数和 rate 的误差不超过 rateMargin
+func (tb *Bucket) setRate(rate float64) {
+	tb.rate = rate
 	for quantum := int64(1); quantum < 1<<50; quantum = nextQuantum(quantum) {
-		fillInterval := time.Duration(float64(time.Second) * float64(quantum) / buck.rate)
+		fillInterval := time.Duration(float64(time.Second) * float64(quantum) / rate)
 		if fillInterval <= 0 {
 			continue
 		}
-		buck.fillInterval = fillInterval
-		buck.quantum = quantum
-		if diff := math.Abs(buck.Rate() - buck.rate); diff/buck.rate <= rateMargin {
+		tb.fillInterval = fillInterval
+		tb.quantum = quantum
+		if diff := math.Abs(tb.currentRate() - rate); diff/rate <= rateMargin {
 			// mean the interval cocret
-			return buck
+			return
 		}
 	}
-	return buck
 }
 
 func nextQuantum(q int64) int64 {
@@ -119,10 +131,111 @@ func nextQuantum(q int64) int64 {
 	return q1
 }
 
-func (tb *Bucket) Wait(count int64) {
-	if d := tb.Take(count); d > 0 {
+func (tb *Bucket) Allow() bool {
+	return tb.AllowN(1)
+}
+
+// AllowN 要么拿到全部 count 个令牌，要么一个都不拿
+func (tb *Bucket) AllowN(count int64) bool {
+	_, ok := tb.TakeMaxDuration(count, 0)
+	return ok
+}
+
+func (tb *Bucket) Reserve() *Reservation {
+	return tb.ReserveN(1)
+}
+
+func (tb *Bucket) ReserveN(count int64) *Reservation {
+	return tb.reserveN(count, infinityDuration)
+}
+
+func (tb *Bucket) ReserveMaxDuration(count int64, maxWait time.Duration) *Reservation {
+	return tb.reserveN(count, maxWait)
+}
+
+func (tb *Bucket) reserveN(count int64, maxWait time.Duration) *Reservation {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if count > tb.capacity {
+		// 和其他限流器一致，超过容量的请求直接拒绝，而不是让桶欠下令牌
+		return &Reservation{clock: tb.clock}
+	}
+	now := tb.clock.Now()
+	d, ok := tb.take(now, count, maxWait)
+	if !ok {
+		// 没有预留，记下本来需要等多久
+		d = tb.timeToTokens(now, count)
+	}
+	r := &Reservation{
+		ok:        ok,
+		clock:     tb.clock,
+		timeToAct: now.Add(d),
+	}
+	if ok && count > 0 {
+		r.cancel = func() { tb.cancel(r, count) }
+	}
+	return r
+}
+
+// cancel 归还预留但还没用上的令牌
+// 在它之后的预留仍然排在原来的位置，所以要扣掉这部分令牌，否则等于凭空多发了令牌
+func (tb *Bucket) cancel(r *Reservation, count int64) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	now := tb.clock.Now()
+	if !r.timeToAct.After(now) {
+		return
+	}
+	restore := count - tb.tokensFromDuration(tb.lastEvent.Sub(r.timeToAct))
+	if restore <= 0 {
+		return
+	}
+	tb.adjustavailableTokens(tb.currentTick(now))
+	tb.availableTokens += restore
+	if tb.availableTokens > tb.capacity {
+		tb.availableTokens = tb.capacity
+	}
+	if r.timeToAct.Equal(tb.lastEvent) {
+		if prevEvent := r.timeToAct.Add(-tb.durationFromTokens(count)); !prevEvent.Before(now) {
+			tb.lastEvent = prevEvent
+		}
+	}
+}
+
+func (tb *Bucket) tokensFromDuration(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64(d/tb.fillInterval) * tb.quantum
+}
+
+func (tb *Bucket) durationFromTokens(count int64) time.Duration {
+	return time.Duration((count+tb.quantum-1)/tb.quantum) * tb.fillInterval
+}
+
+func (tb *Bucket) Wait() error {
+	return tb.WaitN(1)
+}
+
+func (tb *Bucket) WaitN(count int64) error {
+	rv := tb.ReserveN(count)
+	if !rv.OK() {
+		return ErrExceedsLimit
+	}
+	if d := rv.Delay(); d > 0 {
 		tb.clock.Sleep(d)
 	}
+	return nil
+}
+
+// WaitContext 等待直到拿到 count 个令牌
+// ctx 被取消或者截止时间不够等待时提前返回错误，预留的令牌会还回桶里
+func (tb *Bucket) WaitContext(ctx context.Context, count int64) error {
+	maxWait, err := waitBudget(ctx, tb.clock)
+	if err != nil {
+		return err
+	}
+	return tb.reserveN(count, maxWait).Wait(ctx)
 }
 
 func (tb *Bucket) WaitMaxDuration(count int64, maxWait time.Duration) bool {
@@ -169,6 +282,25 @@ func (tb *Bucket) takeAvailable(now time.Time, count int64) int64 {
 	return count
 }
 
+// Refund 还回 count 个已经拿走的令牌，最多补满到容量
+func (tb *Bucket) Refund(count int64) {
+	if count <= 0 {
+		return
+	}
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.adjustavailableTokens(tb.currentTick(tb.clock.Now()))
+	tb.availableTokens += count
+	if tb.availableTokens > tb.capacity {
+		tb.availableTokens = tb.capacity
+	}
+}
+
+// Charge 额外扣掉 count 个令牌，不够时欠着，之后的请求需要等令牌补上来
+func (tb *Bucket) Charge(count int64) {
+	tb.Take(count)
+}
+
 func (tb *Bucket) Available() int64 {
 	return tb.available(tb.clock.Now())
 }
@@ -180,11 +312,107 @@ func (tb *Bucket) available(now time.Time) int64 {
 	return tb.availableTokens
 }
 
+// Throttle 尝试拿 count 个令牌，拿不到时不消耗
+func (tb *Bucket) Throttle(count int64) Result {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	now := tb.clock.Now()
+	tb.adjustavailableTokens(tb.currentTick(now))
+	res := Result{Limit: tb.capacity, RetryAfter: -1}
+	if _, ok := tb.take(now, count, 0); ok {
+		res.Allowed = true
+	} else if count <= tb.capacity {
+		res.RetryAfter = tb.timeToTokens(now, count)
+	}
+	if tb.availableTokens > 0 {
+		res.Remaining = tb.availableTokens
+	}
+	res.ResetAfter = tb.timeToTokens(now, tb.capacity)
+	return res
+}
+
+// timeToTokens 桶里至少有 count 个令牌还要多久，调用前需要先 adjustavailableTokens
+func (tb *Bucket) timeToTokens(now time.Time, count int64) time.Duration {
+	lack := count - tb.availableTokens
+	if lack <= 0 {
+		return 0
+	}
+	endTick := tb.latestTick + (lack+tb.quantum-1)/tb.quantum
+	return tb.startTime.Add(time.Duration(endTick) * tb.fillInterval).Sub(now)
+}
+
+// Idle 桶已经满了，和新建的没有区别
+func (tb *Bucket) Idle() bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.adjustavailableTokens(tb.currentTick(tb.clock.Now()))
+	return tb.availableTokens >= tb.capacity
+}
+
 func (tb *Bucket) Capacity() int64 {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
 	return tb.capacity
 }
 
+// SetCapacity 调整桶的大小，先按原来的容量结算令牌，增加的容量不会变成可用的令牌，
+// 减少时多出来的令牌会被丢掉
+func (tb *Bucket) SetCapacity(capacity int64) {
+	if capacity < 0 {
+		panic("token bucket capacity is not >= 0")
+	}
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.rebase(tb.clock.Now())
+	if tb.availableTokens > capacity {
+		tb.availableTokens = capacity
+	}
+	tb.capacity = capacity
+}
+
+// SetRate 调整为每秒放入 rate 个令牌，之前的时间仍按原来的速率结算
+func (tb *Bucket) SetRate(rate float64) {
+	if rate <= 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		panic("token bucket rate is not > 0")
+	}
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	now := tb.clock.Now()
+	tb.rebase(now)
+	fillInterval := tb.fillInterval
+	tb.setRate(rate)
+	// 不足一个 tick 的进度按比例换算到新的间隔上
+	partial := now.Sub(tb.startTime)
+	tb.startTime = now.Add(-time.Duration(float64(partial) * float64(tb.fillInterval) / float64(fillInterval)))
+}
+
+// SetQuantum 调整每次放入的令牌数，放入的间隔不变
+func (tb *Bucket) SetQuantum(quantum int64) {
+	if quantum <= 0 {
+		panic("token bucket quantum is not > 0")
+	}
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.rebase(tb.clock.Now())
+	tb.quantum = quantum
+}
+
+// rebase 按当前的速率把令牌结算到 now，之后从 now 所在的 tick 重新开始计数，
+// 修改 fillInterval 或者 quantum 后不会影响已经结算的令牌，不足一个 tick 的部分留到下一个 tick
+func (tb *Bucket) rebase(now time.Time) {
+	tick := tb.currentTick(now)
+	tb.adjustavailableTokens(tick)
+	tb.startTime = tb.startTime.Add(time.Duration(tick) * tb.fillInterval)
+	tb.latestTick = 0
+}
+
 func (tb *Bucket) Rate() float64 {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return tb.currentRate()
+}
+
+func (tb *Bucket) currentRate() float64 {
 	return 1e9 * float64(tb.quantum) / float64(tb.fillInterval)
 }
 
@@ -198,6 +426,7 @@ func (tb *Bucket) take(now time.Time, count int64, maxWait time.Duration) (time.
 	avail := tb.availableTokens - count
 	if avail >= 0 {
 		tb.availableTokens = avail
+		tb.lastEvent = now
 		return 0, true
 	}
 
@@ -208,6 +437,7 @@ func (tb *Bucket) take(now time.Time, count int64, maxWait time.Duration) (time.
 		return 0, false
 	}
 	tb.availableTokens = avail
+	tb.lastEvent = endTime
 	return waitTime, true
 }
 
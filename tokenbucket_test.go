@@ -1,8 +1,12 @@
 package ratelimit
 
 import (
+	"context"
+	"errors"
 	"testing"
 	"time"
+
+	"github.com/benbjohnson/clock"
 )
 
 func TestAvailable(t *testing.T) {
@@ -48,7 +52,7 @@ func TestAvailable(t *testing.T) {
 		expectCountAfterTake:  1,
 		expectCountAfterSleep: 2,
 	}} {
-		tb := newBucket(tt.fillInterval, tt.capacity)
+		tb := NewBucket(tt.fillInterval, tt.capacity)
 		if c := tb.takeAvailable(tb.startTime, tt.take); c != tt.take {
 			t.Fatalf("#%d: %s, take = %d, want = %d", i, tt.about, c, tt.take)
 		}
@@ -64,7 +68,7 @@ func TestAvailable(t *testing.T) {
 }
 
 func TestNoBonusTokenAfterBucketIsFull(t *testing.T) {
-	tb := newBucket(time.Second*1, 100, BucketWithQuantum(20))
+	tb := NewBucket(time.Second*1, 100, BucketWithQuantum(20))
 	curAvail := tb.Available()
 	if curAvail != 100 {
 		t.Fatalf("initially: actual available = %d, expected = %d", curAvail, 100)
@@ -87,3 +91,172 @@ func TestNoBonusTokenAfterBucketIsFull(t *testing.T) {
 		t.Fatalf("after taken: actual available = %d, expected = %d", curAvail, 0)
 	}
 }
+
+func TestWaitContext(t *testing.T) {
+	clk := clock.NewMock()
+	clk.Set(time.Now())
+	tb := NewBucket(time.Second, 1, BucketWithClock(clk))
+	if err := tb.WaitContext(context.Background(), 1); err != nil {
+		t.Fatalf("wait with available token: %v", err)
+	}
+
+	if err := tb.WaitContext(withMockDeadline(clk, 10*time.Millisecond), 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("wait longer than deadline: err = %v, want = %v", err, context.DeadlineExceeded)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- tb.WaitContext(ctx, 1)
+	}()
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("wait cancelled: err = %v, want = %v", err, context.Canceled)
+	}
+
+	clk.Add(time.Second)
+	if c := tb.Available(); c != 1 {
+		t.Fatalf("after cancel: available = %d, want = %d", c, 1)
+	}
+}
+
+func TestBucketExceedsCapacity(t *testing.T) {
+	clk := clock.NewMock()
+	clk.Set(time.Now())
+	tb := NewBucket(time.Second, 2, BucketWithClock(clk))
+	r := tb.ReserveN(3)
+	if r.OK() {
+		t.Fatalf("reserve over capacity: ok = true, want = false")
+	}
+	if d := r.Delay(); d != infinityDuration {
+		t.Fatalf("reserve over capacity: delay = %v, want = %v", d, infinityDuration)
+	}
+	if err := tb.WaitContext(context.Background(), 3); !errors.Is(err, ErrExceedsLimit) {
+		t.Fatalf("wait over capacity: err = %v, want = %v", err, ErrExceedsLimit)
+	}
+	// 被拒绝的请求不会让桶欠下令牌
+	if c := tb.Available(); c != 2 {
+		t.Fatalf("after refused: available = %d, want = %d", c, 2)
+	}
+}
+
+func TestReservationCancel(t *testing.T) {
+	clk := clock.NewMock()
+	clk.Set(time.Now())
+	tb := NewBucket(time.Second, 2, BucketWithClock(clk))
+	if !tb.AllowN(2) {
+		t.Fatalf("initially: allow = false, want = true")
+	}
+
+	r1 := tb.ReserveN(2)
+	if d := r1.Delay(); d != 2*time.Second {
+		t.Fatalf("r1: delay = %v, want = %v", d, 2*time.Second)
+	}
+	r2 := tb.Reserve()
+	if d := r2.DelayFrom(clk.Now().Add(time.Second)); d != 2*time.Second {
+		t.Fatalf("r2: delay from 1s later = %v, want = %v", d, 2*time.Second)
+	}
+
+	// r2 keeps its place, so only one of r1's tokens comes back
+	r1.Cancel()
+	r1.Cancel()
+	clk.Add(2 * time.Second)
+	if c := tb.Available(); c != 0 {
+		t.Fatalf("after cancel: available at 2s = %d, want = %d", c, 0)
+	}
+	clk.Add(time.Second)
+	if c := tb.Available(); c != 1 {
+		t.Fatalf("after cancel: available at 3s = %d, want = %d", c, 1)
+	}
+
+	// cancelling a reservation whose time has come gives nothing back
+	r2.Cancel()
+	if c := tb.Available(); c != 1 {
+		t.Fatalf("after late cancel: available = %d, want = %d", c, 1)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	clk := clock.NewMock()
+	clk.Set(time.Now())
+	tb := NewBucket(time.Second, 3, BucketWithClock(clk))
+
+	res := tb.Throttle(2)
+	if !res.Allowed || res.Limit != 3 || res.Remaining != 1 || res.ResetAfter != 2*time.Second {
+		t.Fatalf("take 2 of 3: result = %+v", res)
+	}
+	res = tb.Throttle(2)
+	if res.Allowed || res.Remaining != 1 || res.RetryAfter != time.Second || res.ResetAfter != 2*time.Second {
+		t.Fatalf("take 2 of 1: result = %+v", res)
+	}
+	res = tb.Throttle(4)
+	if res.Allowed || res.RetryAfter != -1 {
+		t.Fatalf("take more than capacity: result = %+v", res)
+	}
+}
+
+func TestSetCapacity(t *testing.T) {
+	clk := clock.NewMock()
+	tb := NewBucket(time.Second, 10, BucketWithClock(clk))
+	tb.TakeAvailable(8)
+
+	// 增加的容量不会变成可用的令牌
+	tb.SetCapacity(15)
+	if got := tb.Available(); got != 2 {
+		t.Fatalf("grow capacity: available = %d, want 2", got)
+	}
+	clk.Add(20 * time.Second)
+	if got := tb.Available(); got != 15 {
+		t.Fatalf("refill after grow: available = %d, want 15", got)
+	}
+	tb.SetCapacity(5)
+	if got := tb.Available(); got != 5 {
+		t.Fatalf("shrink capacity: available = %d, want 5", got)
+	}
+}
+
+func TestBucketSetRate(t *testing.T) {
+	clk := clock.NewMock()
+	tb := NewBucket(time.Second, 100, BucketWithClock(clk))
+	tb.TakeAvailable(100)
+
+	// 之前的 5 秒按原来的速率结算
+	clk.Add(5500 * time.Millisecond)
+	tb.SetRate(10)
+	if got := tb.Available(); got != 5 {
+		t.Fatalf("settle at old rate: available = %d, want 5", got)
+	}
+	if got := tb.Rate(); got != 10 {
+		t.Fatalf("rate = %v, want 10", got)
+	}
+	// 不足一个 tick 的 500ms 按比例换算成新速率下的 50ms
+	clk.Add(50 * time.Millisecond)
+	if got := tb.Available(); got != 6 {
+		t.Fatalf("carry partial tick: available = %d, want 6", got)
+	}
+	clk.Add(time.Second)
+	if got := tb.Available(); got != 16 {
+		t.Fatalf("fill at new rate: available = %d, want 16", got)
+	}
+}
+
+func TestBucketSetQuantum(t *testing.T) {
+	clk := clock.NewMock()
+	tb := NewBucket(time.Second, 100, BucketWithClock(clk))
+	tb.TakeAvailable(100)
+
+	clk.Add(2500 * time.Millisecond)
+	tb.SetQuantum(5)
+	if got := tb.Available(); got != 2 {
+		t.Fatalf("settle at old quantum: available = %d, want 2", got)
+	}
+	// 不足一个 tick 的 500ms 没有丢掉
+	clk.Add(500 * time.Millisecond)
+	if got := tb.Available(); got != 7 {
+		t.Fatalf("carry partial tick: available = %d, want 7", got)
+	}
+	clk.Add(2 * time.Second)
+	if got := tb.Available(); got != 17 {
+		t.Fatalf("fill with new quantum: available = %d, want 17", got)
+	}
+}
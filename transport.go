@@ -0,0 +1,254 @@
+package ratelimit
+
+// 客户端限流，调用有配额限制的第三方接口时使用
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transport 按 key(默认为目标 host)限流的 http.RoundTripper
+// 拿不到许可时按请求的 context 等待，开启 adaptive 后还会根据上游返回的
+// Retry-After、RateLimit、X-RateLimit-* 响应头放慢发送速度
+type Transport struct {
+	base       http.RoundTripper
+	getLimiter func(key string) Limiter
+	keyFunc    KeyFunc
+	clock      Clock
+	adaptive   bool
+
+	gates Store // 每个 key 对应的 *transportGate
+}
+
+type transportOpt func(t *Transport)
+
+// TransportWithBase 实际发送请求的 RoundTripper，默认为 http.DefaultTransport
+func TransportWithBase(base http.RoundTripper) transportOpt {
+	return func(t *Transport) {
+		t.base = base
+	}
+}
+
+// TransportWithKeyFunc 按什么维度限流，默认为 KeyByHost()
+func TransportWithKeyFunc(keyFunc KeyFunc) transportOpt {
+	return func(t *Transport) {
+		t.keyFunc = keyFunc
+	}
+}
+
+func TransportWithClock(clock Clock) transportOpt {
+	return func(t *Transport) {
+		if clock == nil {
+			clock = realClock{}
+		}
+		t.clock = clock
+	}
+}
+
+// TransportWithAdaptive 根据上游的限流响应头调整发送速度
+func TransportWithAdaptive() transportOpt {
+	return func(t *Transport) {
+		t.adaptive = true
+	}
+}
+
+// NewTransport getLimiter 按 key 取出限流器，比如 TokenBuckets(...)、LeakyBuckets(...)
+func NewTransport(getLimiter func(key string) Limiter, opts ...transportOpt) *Transport {
+	t := &Transport{
+		base:       http.DefaultTransport,
+		getLimiter: getLimiter,
+		keyFunc:    KeyByHost(),
+		clock:      realClock{},
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	if t.adaptive {
+		t.gates = defaultStore(nil, t.clock)
+	}
+	return t
+}
+
+// RoundTrip 和 http.RoundTripper 的要求一样，没有发出请求就返回错误时也会关闭 req.Body
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key, err := t.keyFunc(req)
+	if err != nil {
+		closeBody(req)
+		return nil, err
+	}
+	if key == "" {
+		return t.base.RoundTrip(req)
+	}
+
+	var gate *transportGate
+	if t.adaptive {
+		gate = t.gate(key)
+		if err := gate.wait(req.Context()); err != nil {
+			closeBody(req)
+			return nil, err
+		}
+	}
+	if err := t.getLimiter(key).WaitContext(req.Context(), 1); err != nil {
+		closeBody(req)
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if gate != nil {
+		gate.update(resp)
+	}
+	return resp, nil
+}
+
+func (t *Transport) gate(key string) *transportGate {
+	return t.gates.LoadOrStore(key, func() interface{} {
+		return &transportGate{clock: t.clock}
+	}).(*transportGate)
+}
+
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
+
+// transportGate 按上游的响应头调整的本地发送速度，以及上游要求的下一次请求的最早时间
+type transportGate struct {
+	clock Clock
+
+	mu        sync.Mutex
+	notBefore time.Time
+	bucket    *Bucket // 上游给出剩余额度之后才创建，为 nil 时不限速
+}
+
+// wait 先等到上游要求的时间，再按本地的速度排队，并发的请求会依次错开
+// 截止时间之前等不到上游要求的时间时直接返回 context.DeadlineExceeded
+func (g *transportGate) wait(ctx context.Context) error {
+	maxWait, err := waitBudget(ctx, g.clock)
+	if err != nil {
+		return err
+	}
+	g.mu.Lock()
+	d := g.notBefore.Sub(g.clock.Now())
+	bucket := g.bucket
+	g.mu.Unlock()
+	if d > maxWait {
+		return context.DeadlineExceeded
+	}
+	if d > 0 {
+		select {
+		case <-g.clock.After(d):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if bucket == nil {
+		return nil
+	}
+	return bucket.WaitContext(ctx, 1)
+}
+
+// update 有剩余额度时把速度调整为在重置之前均匀地用完，额度用完了等到重置之后；
+// 被限流时等到 Retry-After 之后，没有给出剩余额度的话再把速度减半
+func (g *transportGate) update(resp *http.Response) {
+	now := g.clock.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	limited := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable
+	if limited {
+		if delay, ok := parseRetryAfter(resp.Header.Get(HeaderRetryAfter), now); ok {
+			g.block(now.Add(delay))
+		}
+	}
+	remaining, reset, ok := parseRateLimit(resp.Header, now)
+	switch {
+	case ok && reset > 0 && remaining == 0:
+		g.block(now.Add(reset))
+	case ok && reset > 0:
+		g.setRate(float64(remaining) / reset.Seconds())
+	case limited && g.bucket != nil:
+		g.bucket.SetRate(g.bucket.Rate() / 2)
+	}
+}
+
+// block 在 notBefore 之前不发请求，调用前需要持有锁
+func (g *transportGate) block(notBefore time.Time) {
+	if notBefore.After(g.notBefore) {
+		g.notBefore = notBefore
+	}
+}
+
+// setRate 调用前需要持有锁
+func (g *transportGate) setRate(rate float64) {
+	if g.bucket == nil {
+		g.bucket = NewBucket(time.Second, 1, BucketWithRate(rate), BucketWithClock(g.clock))
+		return
+	}
+	g.bucket.SetRate(rate)
+}
+
+// Idle 上游没有要求等待，也没有请求在排队，丢掉之后恢复为不限速
+func (g *transportGate) Idle() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return !g.notBefore.After(g.clock.Now()) && (g.bucket == nil || g.bucket.Idle())
+}
+
+// parseRetryAfter 秒数或者 HTTP 日期
+func parseRetryAfter(val string, now time.Time) (time.Duration, bool) {
+	val = strings.TrimSpace(val)
+	if val == "" {
+		return 0, false
+	}
+	if secs, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return time.Duration(secs) * time.Second, secs >= 0
+	}
+	if t, err := http.ParseTime(val); err == nil {
+		return t.Sub(now), true
+	}
+	return 0, false
+}
+
+// parseRateLimit 优先使用 RateLimit: limit=N, remaining=N, reset=N，
+// 其次是 X-RateLimit-Remaining 和 X-RateLimit-Reset，后者可能是秒数也可能是 unix 时间戳
+func parseRateLimit(h http.Header, now time.Time) (remaining int64, reset time.Duration, ok bool) {
+	var remainingVal, resetVal string
+	if val := h.Get(HeaderRateLimit); val != "" {
+		for _, item := range strings.Split(val, ",") {
+			kv := strings.SplitN(strings.TrimSpace(item), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch strings.ToLower(kv[0]) {
+			case "remaining":
+				remainingVal = kv[1]
+			case "reset":
+				resetVal = kv[1]
+			}
+		}
+	} else {
+		remainingVal = h.Get(HeaderXRateLimitRemaining)
+		resetVal = h.Get(HeaderXRateLimitReset)
+	}
+
+	remaining, err := strconv.ParseInt(strings.TrimSpace(remainingVal), 10, 64)
+	if err != nil || remaining < 0 {
+		return 0, 0, false
+	}
+	secs, err := strconv.ParseInt(strings.TrimSpace(resetVal), 10, 64)
+	if err != nil || secs < 0 {
+		return 0, 0, false
+	}
+	// 比一年还长的只可能是时间戳
+	if secs > 365*24*3600 {
+		return remaining, time.Unix(secs, 0).Sub(now), true
+	}
+	return remaining, time.Duration(secs) * time.Second, true
+}
@@ -0,0 +1,186 @@
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *int64) {
+	var hits int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		handler(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func get(client *http.Client, url string, timeout time.Duration) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	resp, err := client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return resp, err
+}
+
+func TestTransport(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	srv1, hits1 := newTestServer(t, ok)
+	srv2, hits2 := newTestServer(t, ok)
+	client := &http.Client{Transport: NewTransport(TokenBuckets(time.Hour, 1, 1, nil))}
+
+	_, err := get(client, srv1.URL, time.Second)
+	assert.NoError(t, err)
+	_, err = get(client, srv2.URL, time.Second)
+	assert.NoError(t, err)
+
+	// 需要等一个小时，超过了请求的截止时间
+	start := time.Now()
+	_, err = get(client, srv1.URL+"/other", 100*time.Millisecond)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+	assert.EqualValues(t, 1, atomic.LoadInt64(hits1))
+	assert.EqualValues(t, 1, atomic.LoadInt64(hits2))
+}
+
+func TestTransportWait(t *testing.T) {
+	srv, hits := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	client := &http.Client{Transport: NewTransport(LeakyBuckets(20, nil))}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		_, err := get(client, srv.URL, time.Second)
+		require.NoError(t, err)
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+	assert.EqualValues(t, 3, atomic.LoadInt64(hits))
+}
+
+func TestTransportAdaptive(t *testing.T) {
+	cases := map[string]func(h http.Header) int{
+		"retry after": func(h http.Header) int {
+			h.Set(HeaderRetryAfter, "1")
+			return http.StatusTooManyRequests
+		},
+		"ratelimit": func(h http.Header) int {
+			h.Set(HeaderRateLimit, "limit=10, remaining=0, reset=1")
+			return http.StatusOK
+		},
+		"x-ratelimit": func(h http.Header) int {
+			h.Set(HeaderXRateLimitRemaining, "0")
+			h.Set(HeaderXRateLimitReset, "1")
+			return http.StatusOK
+		},
+	}
+	for name, respond := range cases {
+		t.Run(name, func(t *testing.T) {
+			srv, hits := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(respond(w.Header()))
+			})
+			tr := NewTransport(TokenBuckets(time.Millisecond, 100, 1, nil), TransportWithAdaptive())
+			client := &http.Client{Transport: tr}
+
+			_, err := get(client, srv.URL, time.Second)
+			require.NoError(t, err)
+			// 上游要求等一秒，超过了请求的截止时间，不用等到超时
+			start := time.Now()
+			_, err = get(client, srv.URL, 100*time.Millisecond)
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+			assert.Less(t, time.Since(start), 100*time.Millisecond)
+			assert.EqualValues(t, 1, atomic.LoadInt64(hits))
+		})
+	}
+}
+
+func TestTransportAdaptiveRate(t *testing.T) {
+	srv, hits := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HeaderRateLimit, "limit=10, remaining=2, reset=1")
+	})
+	tr := NewTransport(TokenBuckets(time.Millisecond, 100, 1, nil), TransportWithAdaptive())
+	client := &http.Client{Transport: tr}
+
+	// 剩下的 2 个额度在一秒内均匀地发出去，每 500ms 一个
+	for i := 0; i < 2; i++ {
+		_, err := get(client, srv.URL, time.Second)
+		require.NoError(t, err)
+	}
+	_, err := get(client, srv.URL, 100*time.Millisecond)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.EqualValues(t, 2, atomic.LoadInt64(hits))
+}
+
+// closeRecorder 记录请求的 body 有没有被关闭
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestTransportClosesBodyOnError(t *testing.T) {
+	srv, _ := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	tr := NewTransport(TokenBuckets(time.Hour, 1, 1, nil))
+	newRequest := func() (*http.Request, *closeRecorder) {
+		body := &closeRecorder{Reader: strings.NewReader("ok")}
+		req, _ := http.NewRequest(http.MethodPost, srv.URL, body)
+		return req, body
+	}
+
+	req, _ := newRequest()
+	resp, err := tr.RoundTrip(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	// 等待许可时请求被取消
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, body := newRequest()
+	_, err = tr.RoundTrip(req.WithContext(ctx))
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.True(t, body.closed)
+}
+
+func TestParseRateLimit(t *testing.T) {
+	now := time.Unix(1000000000, 0)
+	cases := []struct {
+		header    map[string]string
+		remaining int64
+		reset     time.Duration
+		ok        bool
+	}{
+		{map[string]string{HeaderRateLimit: "limit=100, remaining=50, reset=30"}, 50, 30 * time.Second, true},
+		{map[string]string{HeaderXRateLimitRemaining: "3", HeaderXRateLimitReset: "60"}, 3, time.Minute, true},
+		{map[string]string{HeaderXRateLimitRemaining: "0", HeaderXRateLimitReset: "1000000010"}, 0, 10 * time.Second, true},
+		{map[string]string{HeaderXRateLimitRemaining: "3"}, 0, 0, false},
+		{map[string]string{}, 0, 0, false},
+	}
+	for _, c := range cases {
+		h := http.Header{}
+		for k, v := range c.header {
+			h.Set(k, v)
+		}
+		remaining, reset, ok := parseRateLimit(h, now)
+		assert.Equal(t, c.ok, ok, c.header)
+		assert.Equal(t, c.remaining, remaining, c.header)
+		assert.Equal(t, c.reset, reset, c.header)
+	}
+
+	d, ok := parseRetryAfter(now.Add(time.Minute).UTC().Format(http.TimeFormat), now)
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, d)
+}